@@ -0,0 +1,113 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Batched socket I/O
+//
+// On a dense mesh, one system call per datagram adds up: every listener reads
+// each packet with its own recvmsg, and every broadcaster sends each packet of
+// a bundle with its own sendmsg. With BatchIO on, listeners read up to
+// batIOBatchSize datagrams per call, and broadcasters send all the packets of
+// a bundle with one call, through the batch APIs of golang.org/x/net/ipv4.
+// On Linux these are recvmmsg and sendmmsg; elsewhere x/net falls back to one
+// datagram per call. On Windows, x/net cannot read or send control messages,
+// so there is no batched I/O.
+
+// Call batchReaderFactory to get a function that will (blocking, 30s) read
+// one or more datagrams from the UDP connection with a single batch read.
+// The ingress function tells from a datagram's control messages which of our
+// addresses it arrived on: fixedIngress for a per-interface socket, or
+// pktinfoIngress for the wildcard socket.
+//
+// The datagrams' data are pooled buffers, only valid until the next call.
+// Once the socket is closed, the buffers go back to the pool, and the reader
+// must not be called again.
+func batchReaderFactory(conn *net.UDPConn, ignore func(ipAddr) bool, ingress func(oob []byte) (ipAddr, bool)) (func() ([]datagram, error), error) {
+	pc := ipv4.NewPacketConn(conn)
+	msgs := make([]ipv4.Message, batIOBatchSize)
+	bufs := make([]*[]byte, batIOBatchSize)
+	for i := range msgs {
+		bufs[i] = getPacketBuffer()
+		msgs[i].Buffers = [][]byte{*bufs[i]}
+		msgs[i].OOB = make([]byte, rxOOBSize)
+	}
+	batch := make([]datagram, 0, batIOBatchSize)
+
+	return func() ([]datagram, error) {
+		// Note: It is CRITCAL that conn MUST have a read deadline set.
+		conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				for _, buf := range bufs {
+					putPacketBuffer(buf)
+				}
+			}
+			return nil, err
+		}
+		now := time.Now()
+		batch = batch[:0]
+		for _, msg := range msgs[:n] {
+			addr, ok := msg.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			// Ignore own transmissions
+			srcAddr := ipAddr(addr.IP.String())
+			if ignore(srcAddr) {
+				continue
+			}
+			oob := msg.OOB[:msg.NN]
+			rxAddress, ok := ingress(oob)
+			if !ok {
+				continue
+			}
+			batch = append(batch, datagram{msg.Buffers[0][:msg.N], srcAddr, rxAddress, rxTimestamp(oob, now)})
+		}
+		return batch, nil
+	}, nil
+}
+
+// batchBroadcasterFactory returns a function that will send several byte
+// slices as UDP packets to the given address, with as few batch writes as
+// possible. Each packet carries the given control messages, if any.
+func batchBroadcasterFactory(conn *net.UDPConn, dst *net.UDPAddr, oob []byte) (func([][]byte) error, error) {
+	pc := ipv4.NewPacketConn(conn)
+	msgs := make([]ipv4.Message, batIOBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+		msgs[i].OOB = oob
+		msgs[i].Addr = dst
+	}
+
+	return func(pkts [][]byte) error {
+		for len(pkts) > 0 {
+			k := min(len(pkts), len(msgs))
+			for i, pkt := range pkts[:k] {
+				msgs[i].Buffers[0] = pkt
+			}
+			n, err := pc.WriteBatch(msgs[:k], 0)
+			if err != nil {
+				return err
+			} else if n == 0 {
+				return fmt.Errorf("broadcaster: WriteBatch: no packets sent")
+			}
+			for i := range pkts[:n] {
+				if msgs[i].N != len(pkts[i]) {
+					return fmt.Errorf("broadcaster: WriteBatch: wrong number of bytes sent: len(pkt)=%v, n=%v", len(pkts[i]), msgs[i].N)
+				}
+			}
+			pkts = pkts[n:]
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,141 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// loopbackPair opens a receiving socket with timestamps on, and a sending
+// socket, on the loopback interface.
+func loopbackPair(tb testing.TB) (rx, tx *net.UDPConn) {
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Skip("batch I/O: no loopback socket:", err)
+	}
+	if err := enableRxTimestamps(rx); err != nil {
+		tb.Fatal("batch I/O:", err)
+	}
+	tx, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal("batch I/O: sender:", err)
+	}
+	tb.Cleanup(func() {
+		rx.Close()
+		tx.Close()
+	})
+	return rx, tx
+}
+
+func TestBatchIO(t *testing.T) {
+	rx, tx := loopbackPair(t)
+	send, err := batchBroadcasterFactory(tx, rx.LocalAddr().(*net.UDPAddr), nil)
+	if err != nil {
+		t.Fatal("batchBroadcasterFactory:", err)
+	}
+	read, err := batchReaderFactory(rx, func(ipAddr) bool { return false }, fixedIngress("127.0.0.1"))
+	if err != nil {
+		t.Fatal("batchReaderFactory:", err)
+	}
+
+	// More packets than fit one batch, each with its own length and content.
+	pkts := make([][]byte, batIOBatchSize+5)
+	for i := range pkts {
+		pkts[i] = make([]byte, i+1)
+		pkts[i][0] = byte(i)
+	}
+	if err := send(pkts); err != nil {
+		t.Fatal("batch I/O: send:", err)
+	}
+	got := 0
+	for got < len(pkts) {
+		batch, err := read()
+		if err != nil {
+			t.Fatal("batch I/O: read:", err)
+		}
+		for _, d := range batch {
+			if len(d.data) != got+1 || d.data[0] != byte(got) {
+				t.Fatalf("batch I/O: packet %d: got %d bytes starting %d", got, len(d.data), d.data[0])
+			}
+			if d.srcAddr != "127.0.0.1" || d.rxAddr != "127.0.0.1" || d.rxTime.IsZero() {
+				t.Error("batch I/O: wrong addressing:", d.srcAddr, d.rxAddr, d.rxTime)
+			}
+			got++
+		}
+	}
+
+	// Own transmissions are dropped, and closing the socket ends reading.
+	ignoring, err := batchReaderFactory(rx, func(addr ipAddr) bool { return addr == "127.0.0.1" }, fixedIngress("127.0.0.1"))
+	if err != nil {
+		t.Fatal("batchReaderFactory:", err)
+	}
+	send(pkts[:1])
+	if batch, err := ignoring(); err != nil || len(batch) != 0 {
+		t.Error("batch I/O: own transmission read:", batch, err)
+	}
+	rx.Close()
+	if _, err := read(); !errors.Is(err, net.ErrClosed) {
+		t.Error("batch I/O: read from closed socket:", err)
+	}
+}
+
+// The benchmarks move batIOBatchSize OGM-sized packets over loopback per
+// iteration, one system call per packet on each side, or in batches.
+
+func benchmarkPackets() [][]byte {
+	pkts := make([][]byte, batIOBatchSize)
+	for i := range pkts {
+		pkts[i] = make([]byte, 1+batMaxBundleSize*batOGMSize)
+	}
+	return pkts
+}
+
+func BenchmarkSinglePacketIO(b *testing.B) {
+	rx, tx := loopbackPair(b)
+	dst := rx.LocalAddr().(*net.UDPAddr)
+	read := singleReads(packetReaderFactory(rx, "127.0.0.1", func(ipAddr) bool { return false }))
+	pkts := benchmarkPackets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pkt := range pkts {
+			if _, err := tx.WriteToUDP(pkt, dst); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for got := 0; got < len(pkts); {
+			batch, err := read()
+			if err != nil {
+				b.Fatal(err)
+			}
+			got += len(batch)
+		}
+	}
+}
+
+func BenchmarkBatchIO(b *testing.B) {
+	rx, tx := loopbackPair(b)
+	send, err := batchBroadcasterFactory(tx, rx.LocalAddr().(*net.UDPAddr), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	read, err := batchReaderFactory(rx, func(ipAddr) bool { return false }, fixedIngress("127.0.0.1"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	pkts := benchmarkPackets()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := send(pkts); err != nil {
+			b.Fatal(err)
+		}
+		for got := 0; got < len(pkts); {
+			batch, err := read()
+			if err != nil {
+				b.Fatal(err)
+			}
+			got += len(batch)
+		}
+	}
+}
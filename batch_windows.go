@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// x/net cannot read or send control messages on Windows, which its batch
+// reads and writes are built on.
+
+var errBatchIO = errors.New("batched I/O not supported on this platform")
+
+func batchReaderFactory(conn *net.UDPConn, ignore func(ipAddr) bool, ingress func(oob []byte) (ipAddr, bool)) (func() ([]datagram, error), error) {
+	return nil, errBatchIO
+}
+
+func batchBroadcasterFactory(conn *net.UDPConn, dst *net.UDPAddr, oob []byte) (func([][]byte) error, error) {
+	return nil, errBatchIO
+}
@@ -2,52 +2,81 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
 	"time"
 )
 
 // The Batman struct holds this node instance's state information.
 type Batman struct {
 	// Node identity information
-	id  nodeID
-	sqn sqn
-
-	// Network interfaces
-	localAddrs     map[ipAddr]bool
-	broadcastAddrs map[ipAddr]net.IP
-	udpAddrs       map[ipAddr]*net.UDPAddr
-	udpConns       map[ipAddr]*net.UDPConn
+	id       nodeID
+	sqn      sqn
+	helloSQN sqn
+	cfg      *Config
+	ogmTimer *trickleTimer // Paces own OGMs
+
+	// Network interfaces, changed only by the OGM handler loop
+	primaryAddr ipAddr                   // Announced in own OGMs, which are only flooded on this interface
+	ifaces      map[ipAddr]*netInterface // Interfaces in use, by local address
+	ownAddrs    atomic.Value             // Snapshot of the addresses in ifaces and their interface indexes, read by the listeners
+	ifaceIndex  atomic.Value             // Snapshot of an address in ifaces for each interface index
+	sharedConn  *net.UDPConn             // The wildcard socket in single socket mode; nil otherwise
+	ifaceEvents chan ifaceEvent          // Broadcasters joining and leaving the OGM bundler
 
 	// Internal queues and channels
-	stop        chan bool
-	outboundOGM chan OGM
-	inboundOGM  chan OGM
+	stop         chan bool
+	outbound     *outboundQueue // OGMs to send, for the bundler
+	inboundOGM   chan OGM       // Received OGMs, for the OGM handler loop
+	inboundDrops *atomic.Uint64 // Received OGMs dropped with inboundOGM full
+	senders      *senderGuard   // Rate limits and quarantine of the senders, for the listeners
+
+	inboundHello       chan hello       // Received hellos, for the OGM handler loop
+	inboundProbeReport chan probeReport // Received probe reports, for the OGM handler loop
+	helloDrops         *atomic.Uint64   // Received hellos dropped with inboundHello full
+	probeReportDrops   *atomic.Uint64   // Received probe reports dropped with inboundProbeReport full
+	probeSeq           uint16
+	thinned            int // Rebroadcasts left out in fish-eye mode
 
 	// Primary data structures
-	nodes     map[nodeID]*routeTracker // replace with globalNodesMap
-	neighbors map[nodeID]nodeLinksMap
+	originators *originatorTable // Neighbors, links, next hops and best routes
 
-	// Computed data structures
-	routingTable routingTableMap
+	// Called for every entry removed by a purge sweep
+	purgeHook func(purgeEvent)
 
 	// ToDo(Sean): Handle system routing table updater through dependancy injection
 }
 
-// New initializes a new Batman node. You only need one.
-func New() Batman {
-	return Batman{
-		id:  "L1",
-		sqn: newDefaultSQN(0),
+// New initializes a new Batman node with the given settings. You only need one.
+func New(cfg Config) Batman {
+	b := Batman{
+		id:       "L1",
+		sqn:      newDefaultSQN(0),
+		helloSQN: newDefaultSQN(0),
+		cfg:      &cfg,
+
+		ifaces:      make(map[ipAddr]*netInterface),
+		ifaceEvents: make(chan ifaceEvent),
+
+		inboundOGM:   make(chan OGM, batInboundQueueSize),
+		inboundDrops: new(atomic.Uint64),
 
-		outboundOGM: make(chan OGM),
-		inboundOGM:  make(chan OGM),
+		inboundHello:       make(chan hello, batHelloQueueSize),
+		inboundProbeReport: make(chan probeReport, batProbeReportQueueSize),
+		helloDrops:         new(atomic.Uint64),
+		probeReportDrops:   new(atomic.Uint64),
 
-		nodes:     make(map[nodeID]*routeTracker),
-		neighbors: make(map[nodeID]nodeLinksMap),
+		purgeHook: logPurgeEvent,
 	}
+	b.originators = newOriginatorTable(b.id, b.cfg)
+	b.outbound = newOutboundQueue(b.id, batOutboundQueueSize)
+	b.senders = newSenderGuard(b.cfg)
+	b.ogmTimer = newTrickleTimer(b.cfg)
+	return b
 	// ToDo(Sean): Flesh out Batman New() function.
 }
 
@@ -66,6 +95,7 @@ func (b *Batman) advertiseOGM() {
 	// Create and send OGM
 	ogm := OGM{
 		Origin:     b.id,
+		OriginAddr: b.primaryAddr,
 		Sender:     b.id,
 		TxAddr:     "", // gets populated on broadcast; ToDo(Sean): Remove TxAddr from raw OGM definition and get from network interface on read
 		PrevSender: "",
@@ -73,149 +103,153 @@ func (b *Batman) advertiseOGM() {
 		SQN:        b.sqn,
 		TTL:        batTTL,
 		Quality:    batTQMaxValue,
+		Throughput: batThroughputMax,
+		Interval:   b.ogmTimer.interval,
 	}
 
 	// Queue for broadcast
-	b.outboundOGM <- ogm
-
-	// Update all link quality estimates using new SQN
-	b.updateLinkEstimates()
+	b.outbound.push(ogm)
 
 	b.rebuildRoutingTable()
 }
 
+// updateLinkEstimates decays every link's windows to where they should be by
+// now, so that neighbors which stopped sending lose their TQ. It runs on the
+// purge tick; see linkData.decay.
 func (b *Batman) updateLinkEstimates() {
-	// ToDo(Sean): Flesh out updateLinkEstimates() function.
+	now := time.Now()
+	b.originators.forEachLink(func(id nodeID, key linkKey, link *linkData) {
+		link.decay(now, b.helloSQN, b.cfg.HelloInterval.Duration)
+	})
 }
 
+// rebuildRoutingTable selects the best next hop for every known node.
 func (b *Batman) rebuildRoutingTable() {
-	// ToDo(Sean): Flesh out rebuildRoutingTable() function.
+	b.originators.refreshRoutes(time.Now())
 }
 
-// startOGMBundler starts a go-routine for grabbing OGMs off the outbound ogm queue,
-// bundling them up, and passing them off onto the outbound bundle queue.
-func (b *Batman) startOGMBundler() <-chan []RawOGM {
-	outboundBundle := make(chan []RawOGM)
-	go func(outboundBundle chan<- []RawOGM) {
-		defer close(outboundBundle)
-
-		// initialize and stop a timer so it's ready for later use
-		timeout := time.NewTimer(1 * time.Second)
-		if !timeout.Stop() {
-			<-timeout.C
-		}
-		timerRunning := false
-
-		// sit listening for outbound OGMs and send them out in bundles
-		bundle := make([]RawOGM, 0, batMaxBundleSize)
+// startNetworkListener starts the goroutine for one socket: that of a single
+// network interface, or the shared one in single socket mode. It loops making
+// blocking network read calls, receiving incoming UDP packets, and passing
+// them on by packet type, until the socket is closed. Each read returns one
+// datagram, or a batch of them with batched I/O.
+func (b *Batman) startNetworkListener(conn *net.UDPConn, read func() ([]datagram, error)) {
+	go func(conn *net.UDPConn, read func() ([]datagram, error)) {
+		probes := newProbeTimer()
 		for {
 			select {
-			// ToDo(Sean): Check this for possible race condition on timer... what if it triggers between the if and the stop?
-			case ogm := <-b.outboundOGM:
-				bundle = append(bundle, ogm.Pack())
-				if len(bundle) >= batMaxBundleSize {
-					timerRunning = false
-					if !timeout.Stop() {
-						<-timeout.C
-					}
-					// flush bundle to output
-					outboundBundle <- bundle
-					bundle = bundle[:0]
-				} else if !timerRunning {
-					timerRunning = true
-					timeout.Reset(batMaxBundleDelay * time.Millisecond)
-				}
-			case <-timeout.C:
-				timerRunning = false
-				// flush bundle to output
-				outboundBundle <- bundle
-				bundle = bundle[:0]
 			case <-b.stop:
 				return
+			default:
+				batch, err := read()
+				if errors.Is(err, net.ErrClosed) {
+					return // interface removed
+				}
+				for _, d := range batch {
+					if len(d.data) > 0 {
+						b.handleDatagram(conn, probes, d)
+					}
+				}
 			}
 		}
-	}(outboundBundle)
-
-	return outboundBundle
+	}(conn, read)
 }
 
-// startNetworkListeners starts one goroutine for each network interface.
-// Each goroutine loops making blocking network read calls, receiving
-// incoming UDP packets of OGM bundles, parsing OGMs, and feeding them
-// one at a time to the Batman node's inboundOGM channel.
-func (b *Batman) startNetworkListeners() error {
-	for _, conn := range b.udpConns {
-		receive := ogmReaderFactory(conn, b.localAddrs)
-		go func(receive func() ([]OGM, error)) {
-			for {
-				select {
-				case <-b.stop:
-					return
-				default:
-					if ogms, err := receive(); err == nil {
-						for _, ogm := range ogms {
-							// ToDo(Sean): Populate TxAddr field with sender's IP (requires modifying receive)
-							b.inboundOGM <- ogm
-						}
-					}
-				}
+// handleDatagram parses a received datagram according to its packet type and
+// passes the result on. Probes are answered right here on the listener's
+// connection; everything else is handed to the OGM handler. Packets from
+// quarantined senders, malformed packets and whatever exceeds the sender's
+// rate are dropped; see senderGuard.
+func (b *Batman) handleDatagram(conn *net.UDPConn, probes *probeTimer, d datagram) {
+	if !b.senders.admit(d.srcAddr, d.rxTime) {
+		return
+	}
+	switch d.data[0] {
+	case batPacketHello:
+		h, err := parseHello(d.data, d)
+		if err != nil {
+			b.reportMalformed(d, err)
+		} else if b.senders.allow(d.srcAddr, 1, d.rxTime) == 1 {
+			b.queueHello(h)
+		}
+	case batPacketProbe:
+		probe, err := parseProbe(d.data)
+		if err != nil {
+			b.reportMalformed(d, err)
+			return
+		}
+		if b.senders.allow(d.srcAddr, 1, d.rxTime) == 0 {
+			return
+		}
+		if throughput, ok := probes.receive(d.srcAddr, probe, len(d.data), d.rxTime); ok {
+			var msg []byte
+			packProbeReport(&msg, RawProbeReport{batPacketProbeReport, b.id.raw(), probe.Seq, throughput})
+			if index, ok := b.ownIndex(d.rxAddr); ok {
+				b.sendTo(conn, msg, index, d.rxAddr, d.srcAddr)
 			}
-		}(receive)
+		}
+	case batPacketProbeReport:
+		report, err := parseProbeReport(d.data)
+		if err != nil {
+			b.reportMalformed(d, err)
+		} else if b.senders.allow(d.srcAddr, 1, d.rxTime) == 1 {
+			b.queueProbeReport(probeReport{linkKey{d.rxAddr, d.srcAddr}, report.Throughput})
+		}
+	default:
+		ogms, err := parseOGMs(d.data, d.rxAddr)
+		if err != nil {
+			b.reportMalformed(d, err)
+			return
+		}
+		ogms = ogms[:b.senders.allow(d.srcAddr, len(ogms), d.rxTime)]
+		for _, ogm := range ogms {
+			ogm.TxAddr = d.srcAddr // Trust the packet's source address over the sender's claim
+			ogm.RxTime = d.rxTime
+			b.queueInbound(ogm)
+		}
 	}
-	return nil
 }
 
-// startNetworkBroadcasters is responsible for putting OGM bunles on the wire.
-// It spawns one goroutine per network interface, and one more to replicate the
-// outbound OGM bundles for each network interface goroutine.
-func (b *Batman) startNetworkBroadcasters(outboundBundle <-chan []RawOGM) error {
-	if len(b.udpConns) < 1 {
-		return errors.New("startNetworkBroadcasters: cannot start: no UDP connections")
+// reportMalformed counts a malformed datagram against its sender, and logs
+// the sender's quarantine if that got it quarantined.
+func (b *Batman) reportMalformed(d datagram, err error) {
+	if b.senders.reportMalformed(d.srcAddr, d.rxTime) {
+		log.Println("sender quarantined:", d.srcAddr, "for", b.cfg.QuarantineTime, "after malformed packets, last:", err)
 	}
+}
 
-	// ToDo(Sean): Eventually, add mechanism for adding and and removing interfaces at runtime?
-
-	// spin up a broadcaster for each network interface
-	bcastChans := make([](chan []RawOGM), 0, len(b.udpConns))
-	for ip, conn := range b.udpConns {
-		perConChan := make(chan []RawOGM)
-		bcastChans = append(bcastChans, perConChan)
-
-		broadcast := broadcasterFactory(conn, ip, b.broadcastAddrs[ip])
-
-		go func(perConChan chan []RawOGM, txAddr [4]byte, broadcast func([]byte) error) {
-			msg := make([]byte, batSafePacketSize)
-			customBundle := make([]RawOGM, 0, batMaxBundleSize)
-
-			for bundle := range perConChan {
-				customBundle = customBundle[:0]
-				msg = msg[:0]
-				// customize each OGM in bundle with correct txAddr
-				for i := range bundle {
-					// customBundle[i] = bundle[i]
-					customBundle = append(customBundle, bundle[i])
-					customBundle[i].TxAddr = txAddr
+// startNetworkBroadcaster starts the goroutine that broadcasts the OGM
+// bundle packets for one network interface, until its packet channel is
+// closed. Packets that are waiting together are sent together, with a single
+// system call if batched I/O is on.
+func (b *Batman) startNetworkBroadcaster(iface *netInterface) {
+	go func(iface *netInterface) {
+		bufs := make([]*[]byte, 0, batIOBatchSize)
+		pkts := make([][]byte, 0, batIOBatchSize)
+		for pkt := range iface.packets {
+			bufs = append(bufs[:0], pkt)
+		waiting:
+			for len(bufs) < batIOBatchSize {
+				select {
+				case pkt, ok := <-iface.packets:
+					if !ok {
+						break waiting
+					}
+					bufs = append(bufs, pkt)
+				default:
+					break waiting
 				}
-				packOGMs(&msg, customBundle)
-				_ = broadcast(msg) // ToDo(Sean): Maybe log err message?
 			}
-		}(perConChan, ip.raw(), broadcast)
-	}
-
-	// replicate an outbound OGM bundle for all interfaces
-	go func() {
-		for bundle := range outboundBundle {
-			for _, c := range bcastChans {
-				c <- bundle
+			pkts = pkts[:0]
+			for _, buf := range bufs {
+				pkts = append(pkts, *buf)
+			}
+			_ = iface.broadcastAll(pkts) // ToDo(Sean): Maybe log err message?
+			for _, buf := range bufs {
+				putPacketBuffer(buf)
 			}
 		}
-		// trigger shutdown of all broadcast gorutines
-		for _, c := range bcastChans {
-			close(c)
-		}
-		return
-	}()
-	return nil
+	}(iface)
 }
 
 // Run starts the Batman instance.
@@ -224,53 +258,94 @@ func (b *Batman) Run() (err error) {
 
 	// Network services //
 
-	// Find network interfaces and create sockets
-	b.localAddrs, b.broadcastAddrs = localAndBroadcastAddresses()
-	if b.udpAddrs, err = resolveUDPAddresses(b.localAddrs, batUDPPortStr); err != nil {
-		fmt.Println(err)
-		return
-	}
-	if b.udpConns, err = openSockets(b.udpAddrs); err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer closeSockets(b.udpConns)
+	// Start Services: Bundle and Broadcast
+	b.startOGMBundler()
 
-	// Start Services: Bundle, Listen, Broadcast
-	outboundBundle := b.startOGMBundler()
-	if err = b.startNetworkBroadcasters(outboundBundle); err != nil {
-		fmt.Println(err)
-		return
+	// In single socket mode, one listener serves all interfaces.
+	if b.cfg.SingleSocket {
+		if b.sharedConn, err = openWildcardSocket(batUDPPortInt); err != nil {
+			log.Println(err)
+			return
+		}
+		defer b.sharedConn.Close()
+		var read func() ([]datagram, error)
+		if read, err = b.readerFactory(b.sharedConn, ""); err != nil {
+			log.Println(err)
+			return
+		}
+		b.startNetworkListener(b.sharedConn, read)
 	}
-	if err = b.startNetworkListeners(); err != nil {
-		fmt.Println(err)
-		return
+
+	// Find network interfaces, create sockets and start a listener and a
+	// broadcaster for each. Running without any interfaces is fine; they are
+	// picked up by later rescans as they appear.
+	b.rescanInterfaces()
+	defer b.closeInterfaces()
+	if len(b.ifaces) == 0 {
+		log.Println("no usable interfaces yet")
 	}
 
 	// BATMAN services //
 
-	// Start self ogm advertiser
-	go func() {
-		advertTimer := time.NewTimer(batOGMInterval * time.Second)
-		for {
-			select {
-			case <-b.stop:
-				return
-			case <-advertTimer.C:
-				b.advertiseOGM()
-				advertTimer.Reset(batOGMInterval*time.Second + time.Duration(rand.Int63n(batOGMJitter))*time.Millisecond)
-			}
-		}
-	}()
+	// Self OGM advertising, hellos and link probing share the OGM handler's
+	// loop, so that all routing state is owned by a single goroutine.
+	nextOGM := time.Now().Add(b.ogmTimer.interval)
+	advertTimer := time.NewTimer(b.ogmTimer.interval)
+	defer advertTimer.Stop()
+	helloTimer := time.NewTimer(b.cfg.HelloInterval.Duration)
+	defer helloTimer.Stop()
+	purgeTicker := time.NewTicker(b.cfg.PurgeInterval.Duration)
+	defer purgeTicker.Stop()
+	rescanTicker := time.NewTicker(b.cfg.InterfaceScanInterval.Duration)
+	defer rescanTicker.Stop()
+	statusSignal := make(chan os.Signal, 1)
+	notifyStatus(statusSignal)
+	defer signal.Stop(statusSignal)
+	var probeTick <-chan time.Time
+	if b.cfg.Metric == metricThroughput {
+		probeTicker := time.NewTicker(b.cfg.ProbeInterval.Duration)
+		defer probeTicker.Stop()
+		probeTick = probeTicker.C
+	}
 
 	// Start OGM handler
 	for {
 		select {
 		case <-b.stop:
 			return
+		case now := <-advertTimer.C:
+			b.advertiseOGM()
+			nextOGM = now.Add(b.ogmTimer.fire() + time.Duration(rand.Int63n(batOGMJitter))*time.Millisecond)
+			advertTimer.Reset(time.Until(nextOGM))
+		case <-helloTimer.C:
+			b.sendHellos()
+			helloTimer.Reset(b.cfg.HelloInterval.Duration + time.Duration(rand.Int63n(batHelloJitter))*time.Millisecond)
+		case now := <-purgeTicker.C:
+			// Decay on a steady clock, whatever the own OGM interval
+			b.updateLinkEstimates()
+			b.purge(now)
+		case <-rescanTicker.C:
+			b.rescanInterfaces()
+		case <-statusSignal:
+			log.Print(b.status())
+		case h := <-b.inboundHello:
+			b.processHello(h)
+		case <-probeTick:
+			b.sendProbes()
+		case report := <-b.inboundProbeReport:
+			b.processProbeReport(report)
 		case ogm := <-b.inboundOGM:
 			b.processAndForward(ogm) // apply forwarding rules and update metrics
 		}
+
+		// A topology change brings the next own OGM forward, in adaptive mode.
+		if b.ogmTimer.observe(b.originators.changes) {
+			if soon := time.Now().Add(b.ogmTimer.interval); soon.Before(nextOGM) {
+				nextOGM = soon
+				stopTimer(advertTimer)
+				advertTimer.Reset(time.Until(nextOGM))
+			}
+		}
 	}
 }
 
@@ -279,12 +354,28 @@ func (b *Batman) rebroadcast(ogm OGM) {
 		log.Println("rebroadcast() called on OGM with <1 TTL")
 		return
 	}
-	var lossFactor byte = 1 // TODO(Sean): Replace this with correct hop penalty!
+	if ogm.TTL == 1 {
+		return // Neighbors would only drop it as expired
+	}
+	if !b.thin(&ogm) {
+		return
+	}
+	// Both metrics are carried forward, so that the path values in the OGM
+	// include our link to the sender and the hop penalty.
+	var linkTQ byte
+	var linkRate uint32
+	key := linkKey{ogm.RxAddr, ogm.TxAddr}
+	if _, link, ok := b.originators.linkTo(key); ok {
+		linkTQ = link.tq
+		linkRate = b.originators.linkThroughput(key, link)
+	}
 
 	ogm.PrevSender = ogm.Sender
 	ogm.PrevAddr = ogm.TxAddr
 	ogm.Sender = b.id
 	ogm.TTL -= 1
-	ogm.Quality = ogm.Quality * lossFactor
-	b.outboundOGM <- ogm
+	penalty := b.originators.hopPenalty(ogm.RxAddr)
+	ogm.Quality = pathTQ(ogm.Quality, linkTQ, penalty)
+	ogm.Throughput = pathThroughput(ogm.Throughput, linkRate, penalty)
+	b.outbound.push(ogm)
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"time"
+)
+
+// OGM bundling
+//
+// OGMs are not sent one per packet. The bundler keeps an ogmQueue for each
+// interface, and every OGM to send goes into each interface's queue, adapted
+// to the interface: with the interface's address as TxAddr, and, if it is one
+// of our own, thinned out to the interface's OGM interval and with its TTL
+// capped on secondary interfaces. A queue is flushed into a packet once it
+// holds as many OGMs as fit the interface's MTU, or once its oldest OGM has
+// waited batMaxBundleDelay.
+//
+// The ogmBundler itself holds no timers and never reads the clock; it is
+// handed the current time, so that tests can run it on a fake clock. The
+// goroutine started by startOGMBundler drives it with real time.
+
+// An ogmBundler keeps the OGM queues of all interfaces.
+type ogmBundler struct {
+	self   [4]byte       // Our own node ID, which tells own OGMs
+	delay  time.Duration // Longest an OGM waits for others to share its packet
+	queues map[ipAddr]*ifaceQueue
+}
+
+// An ifaceQueue is the OGM queue of one interface.
+type ifaceQueue struct {
+	*ogmQueue
+	iface   *netInterface
+	lastOwn time.Time // When an own OGM was last queued, for the OGM interval
+	own     bool      // Whether an own OGM is queued
+}
+
+// A bundlePacket is a flushed OGM bundle and the interface it goes out on.
+// The packet is a pooled buffer; the broadcaster puts it back once sent.
+type bundlePacket struct {
+	iface *netInterface
+	pkt   *[]byte
+	own   bool // Whether the packet carries an own OGM
+}
+
+func newOGMBundler(self [4]byte, delay time.Duration) *ogmBundler {
+	return &ogmBundler{self, delay, make(map[ipAddr]*ifaceQueue)}
+}
+
+// addInterface starts a queue for an interface.
+func (u *ogmBundler) addInterface(iface *netInterface) {
+	perPacket := min(batMaxBundleSize, (iface.info.settings.mtu-1)/batOGMSize)
+	u.queues[iface.addr] = &ifaceQueue{ogmQueue: newOGMQueue(perPacket), iface: iface}
+}
+
+// removeInterface drops an interface's queue, along with any OGMs in it.
+func (u *ogmBundler) removeInterface(addr ipAddr) (*netInterface, bool) {
+	q, ok := u.queues[addr]
+	if !ok {
+		return nil, false
+	}
+	delete(u.queues, addr)
+	return q.iface, true
+}
+
+// add queues an OGM on every interface, and returns the packets of the
+// queues it filled.
+func (u *ogmBundler) add(ogm RawOGM, now time.Time) []bundlePacket {
+	var out []bundlePacket
+	for _, q := range u.queues {
+		custom := ogm
+		custom.TxAddr = q.iface.addr.raw()
+		if custom.Origin == u.self {
+			if !q.lastOwn.IsZero() && now.Sub(q.lastOwn) < q.iface.info.settings.ogmInterval {
+				continue
+			}
+			q.lastOwn = now
+			q.own = true
+			// own OGMs on secondary interfaces only serve neighbors
+			if !q.iface.primary.Load() && custom.TTL > batSecondaryTTL {
+				custom.TTL = batSecondaryTTL
+			}
+		}
+		if _, full := q.addOGM(custom, now.Add(u.delay)); full {
+			out = append(out, q.flushPacket())
+		}
+	}
+	return out
+}
+
+// flushDue flushes the queues whose oldest OGM has waited long enough.
+func (u *ogmBundler) flushDue(now time.Time) []bundlePacket {
+	var out []bundlePacket
+	for _, q := range u.queues {
+		if q.due(now) {
+			out = append(out, q.flushPacket())
+		}
+	}
+	return out
+}
+
+// nextDeadline returns the earliest time a queue is due, if any holds OGMs.
+func (u *ogmBundler) nextDeadline() (deadline time.Time, ok bool) {
+	for _, q := range u.queues {
+		if q.count > 0 && (!ok || q.deadline.Before(deadline)) {
+			deadline, ok = q.deadline, true
+		}
+	}
+	return
+}
+
+// flushPacket packs the queue, which must not be empty, into a packet.
+func (q *ifaceQueue) flushPacket() bundlePacket {
+	buf := getPacketBuffer()
+	*buf, _ = q.flush((*buf)[:0])
+	own := q.own
+	q.own = false
+	return bundlePacket{q.iface, buf, own}
+}
+
+// startOGMBundler starts the goroutine that bundles the outbound OGMs into a
+// packet for each interface, and hands the packets to the interfaces'
+// broadcasters. Broadcasters join and leave through ifaceEvents as interfaces
+// come and go, and are all stopped when the bundler stops. The bundler never
+// blocks on a broadcaster; see queuePacket.
+func (b *Batman) startOGMBundler() {
+	go func() {
+		bundler := newOGMBundler(b.id.raw(), batMaxBundleDelay*time.Millisecond)
+		defer func() {
+			for addr := range bundler.queues {
+				iface, _ := bundler.removeInterface(addr)
+				close(iface.packets)
+			}
+		}()
+
+		// The timer is only armed while some queue holds OGMs. Should it
+		// fire late, after the queue was flushed at highwater, flushDue
+		// finds nothing due and sends nothing.
+		timer := time.NewTimer(time.Hour)
+		stopTimer(timer)
+		var ogms []OGM
+		for {
+			var due <-chan time.Time
+			if deadline, ok := bundler.nextDeadline(); ok {
+				timer.Reset(time.Until(deadline))
+				due = timer.C
+			}
+
+			var out []bundlePacket
+			select {
+			case <-b.outbound.ready:
+				now := time.Now()
+				// A bundle's worth at a time, so that the queue's
+				// scheduling decides what goes out first.
+				ogms = b.outbound.take(ogms, batMaxBundleSize)
+				for _, ogm := range ogms {
+					out = append(out, bundler.add(ogm.Pack(), now)...)
+				}
+			case now := <-due:
+				out = bundler.flushDue(now)
+			case e := <-b.ifaceEvents:
+				if e.iface != nil {
+					bundler.addInterface(e.iface)
+				} else if iface, ok := bundler.removeInterface(e.addr); ok {
+					close(iface.packets)
+				}
+			case <-b.stop:
+				stopTimer(timer)
+				return
+			}
+			stopTimer(timer)
+
+			for _, p := range out {
+				queuePacket(p)
+			}
+		}
+	}()
+}
+
+// stopTimer stops a timer and drains its channel, so that it can be reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
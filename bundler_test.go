@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A fakeClock is advanced by hand, for driving the ogmBundler in tests.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func testInterface(addr ipAddr, settings ifaceSettings, primary bool) *netInterface {
+	iface := &netInterface{addr: addr, info: ifaceInfo{name: "wlan0", settings: settings}}
+	iface.primary.Store(primary)
+	return iface
+}
+
+// packetOGMs parses the OGMs back out of bundle packets.
+func packetOGMs(t *testing.T, packets []bundlePacket) map[ipAddr][][]OGM {
+	t.Helper()
+	out := make(map[ipAddr][][]OGM)
+	for _, p := range packets {
+		ogms, err := parseOGMs(*p.pkt, p.iface.addr)
+		if err != nil || len(ogms) == 0 {
+			t.Fatal("bundler: bad packet:", *p.pkt, err)
+		}
+		out[p.iface.addr] = append(out[p.iface.addr], ogms)
+		putPacketBuffer(p.pkt)
+	}
+	return out
+}
+
+func TestBundlerHighwater(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	bundler := newOGMBundler([4]byte{'L', '1'}, time.Second)
+
+	// A small MTU fills a packet with fewer OGMs than a large one.
+	small := defaultIfaceSettings()
+	small.mtu = 1 + 2*batOGMSize
+	bundler.addInterface(testInterface("10.0.0.1", defaultIfaceSettings(), true))
+	bundler.addInterface(testInterface("10.1.0.1", small, false))
+
+	ogm := sampleOGM
+	var sent []bundlePacket
+	for i := 0; i < batMaxBundleSize; i++ {
+		sent = append(sent, bundler.add(ogm, clock.advance(time.Millisecond))...)
+	}
+	packets := packetOGMs(t, sent)
+	if len(packets["10.1.0.1"]) != batMaxBundleSize/2 || len(packets["10.0.0.1"]) != 1 {
+		t.Fatal("bundler: wrong packets at highwater:", len(packets["10.1.0.1"]), len(packets["10.0.0.1"]))
+	}
+	for _, ogms := range packets["10.1.0.1"] {
+		if len(ogms) != 2 || ogms[0].TxAddr != "10.1.0.1" {
+			t.Error("bundler: wrong packet for small MTU:", ogms)
+		}
+	}
+	if ogms := packets["10.0.0.1"][0]; len(ogms) != batMaxBundleSize || ogms[0].TxAddr != "10.0.0.1" {
+		t.Error("bundler: wrong full packet:", ogms)
+	}
+
+	// Flushed at highwater, nothing is left to send at the deadline.
+	if _, ok := bundler.nextDeadline(); ok {
+		t.Error("bundler: deadline without queued OGMs")
+	}
+	if out := bundler.flushDue(clock.advance(time.Hour)); len(out) != 0 {
+		t.Error("bundler: empty packets sent:", len(out))
+	}
+}
+
+func TestBundlerDeadline(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	bundler := newOGMBundler([4]byte{'L', '1'}, 200*time.Millisecond)
+	bundler.addInterface(testInterface("10.0.0.1", defaultIfaceSettings(), true))
+
+	first := clock.now
+	if out := bundler.add(sampleOGM, first); len(out) != 0 {
+		t.Fatal("bundler: sent before highwater or deadline")
+	}
+	bundler.add(sampleOGM, clock.advance(150*time.Millisecond))
+	if deadline, ok := bundler.nextDeadline(); !ok || !deadline.Equal(first.Add(200*time.Millisecond)) {
+		t.Error("bundler: deadline not set by the oldest OGM:", deadline, ok)
+	}
+	if out := bundler.flushDue(clock.advance(49 * time.Millisecond)); len(out) != 0 {
+		t.Error("bundler: flushed before the deadline")
+	}
+	packets := packetOGMs(t, bundler.flushDue(clock.advance(time.Millisecond)))
+	if len(packets["10.0.0.1"]) != 1 || len(packets["10.0.0.1"][0]) != 2 {
+		t.Error("bundler: wrong packets at deadline:", packets)
+	}
+	if out := bundler.flushDue(clock.advance(time.Second)); len(out) != 0 {
+		t.Error("bundler: empty packet sent after flush")
+	}
+
+	// A removed interface's queue goes with it.
+	bundler.add(sampleOGM, clock.now)
+	if _, ok := bundler.removeInterface("10.0.0.1"); !ok {
+		t.Error("bundler: interface not removed")
+	}
+	if _, ok := bundler.nextDeadline(); ok {
+		t.Error("bundler: removed interface still due")
+	}
+}
+
+func TestBundlerOwnOGMs(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	self := [4]byte{'L', '1'}
+	bundler := newOGMBundler(self, time.Second)
+	slow := defaultIfaceSettings()
+	slow.ogmInterval = 3 * time.Second
+	bundler.addInterface(testInterface("10.0.0.1", defaultIfaceSettings(), true))
+	bundler.addInterface(testInterface("10.1.0.1", slow, false))
+
+	own := sampleOGM
+	own.Origin = self
+	own.TTL = batTTL
+	for i := 0; i < 5; i++ {
+		bundler.add(own, clock.advance(time.Second))
+	}
+	packets := packetOGMs(t, bundler.flushDue(clock.advance(time.Second)))
+	primary, secondary := packets["10.0.0.1"][0], packets["10.1.0.1"][0]
+	if len(primary) != 5 || primary[0].TTL != batTTL {
+		t.Error("bundler: own OGMs on primary interface:", primary)
+	}
+	// Thinned to the interface's OGM interval, and only for neighbors.
+	if len(secondary) != 2 || secondary[0].TTL != batSecondaryTTL {
+		t.Error("bundler: own OGMs on secondary interface:", secondary)
+	}
+}
+
+func TestStartOGMBundler(t *testing.T) {
+	b := New(defaultConfig())
+	b.stop = make(chan bool)
+	b.startOGMBundler()
+
+	sent := make(chan []byte, 4)
+	iface := testInterface("10.0.0.1", defaultIfaceSettings(), true)
+	iface.packets = make(chan *[]byte)
+	iface.broadcast = func(pkt []byte) error {
+		sent <- append([]byte(nil), pkt...)
+		return nil
+	}
+	b.startNetworkBroadcaster(iface)
+	b.ifaceEvents <- ifaceEvent{iface.addr, iface}
+
+	// A lone OGM goes out once its deadline comes, and nothing after it.
+	b.outbound.push(sampleOGM.Unpack())
+	select {
+	case pkt := <-sent:
+		if pkt[0] != 1 {
+			t.Error("startOGMBundler: wrong packet:", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("startOGMBundler: OGM not sent by the deadline")
+	}
+	select {
+	case pkt := <-sent:
+		t.Error("startOGMBundler: extra packet sent:", pkt)
+	case <-time.After(2 * batMaxBundleDelay * time.Millisecond):
+	}
+
+	close(b.stop)
+	select {
+	case _, ok := <-iface.packets:
+		if ok {
+			t.Error("startOGMBundler: packet after stop")
+		}
+	case <-time.After(time.Second):
+		t.Error("startOGMBundler: broadcaster not stopped")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Metric modes select how path quality is measured and propagated in OGMs.
+const (
+	metricTQ         = "tq"         // BATMAN IV: packet delivery ratio (TQ)
+	metricThroughput = "throughput" // BATMAN V style: path bottleneck throughput
+)
+
+// Config holds the settings of a Batman instance that may differ between
+// deployments. Fields are exported so that it can be read from a JSON file;
+// anything left out of the file keeps its value from defaultConfig.
+type Config struct {
+	// Metric is the routing metric mode, either metricTQ or metricThroughput.
+	Metric string
+
+	// PrimaryAddr is the address of the primary interface, which the node
+	// announces in its OGMs and floods them on with full TTL. Own OGMs on the
+	// other, secondary, interfaces only reach neighbors. If left empty, or if
+	// no interface has the address, the lowest local address is used.
+	PrimaryAddr ipAddr
+
+	// LinkRates holds configured link throughputs (kbit/s), keyed either by a
+	// neighbor's link address or by one of our own interface addresses.
+	// A configured rate takes precedence over probing.
+	LinkRates map[ipAddr]uint32
+
+	// DefaultLinkRate (kbit/s) is assumed for links that are neither
+	// configured nor successfully probed yet.
+	DefaultLinkRate uint32
+
+	// ProbeInterval is the time between unicast throughput probes sent to
+	// each neighbor link. Probes are only sent in the throughput metric mode.
+	ProbeInterval duration
+
+	// HelloInterval is the time between ELP hellos sent on each interface.
+	// Hellos sense links, so it is usually shorter than the OGM interval.
+	HelloInterval duration
+
+	// OGMInterval is the time between own OGMs. With AdaptiveOGMInterval,
+	// it is the shortest interval: the interval doubles after every OGM up
+	// to MaxOGMInterval while the topology is stable, and drops back to
+	// OGMInterval when links come or go or routes change. Own OGMs advertise
+	// the interval in use.
+	OGMInterval         duration
+	AdaptiveOGMInterval bool
+	MaxOGMInterval      duration
+
+	// WindowSize is the number of hellos over which each link's RQ and EQ
+	// are measured.
+	WindowSize int
+
+	// TQWindowSize is the number of recent OGM SQNs over which the TQ that
+	// an originator reports through each next hop is averaged.
+	TQWindowSize int
+
+	// LinkTimeout, HopTimeout and OriginatorTimeout are how long a neighbor
+	// link, a next hop towards an originator, and an originator may go
+	// without being refreshed before they are purged. Sweeps for timed out
+	// entries run every PurgeInterval.
+	LinkTimeout       duration
+	HopTimeout        duration
+	OriginatorTimeout duration
+	PurgeInterval     duration
+
+	// InterfaceScanInterval is the time between rescans of the local
+	// addresses, which pick up interfaces that came up or went away.
+	InterfaceScanInterval duration
+
+	// SingleSocket serves all interfaces from one socket bound to the
+	// wildcard address, instead of one socket per interface address. The
+	// interface each packet arrives on is then told by IP_PKTINFO, so it
+	// is only supported on Linux.
+	SingleSocket bool
+
+	// BatchIO reads and sends many datagrams per system call, with recvmmsg
+	// and sendmmsg on Linux, instead of one. It saves CPU on dense meshes.
+	// It is not supported on Windows.
+	BatchIO bool
+
+	// FishEyeStride above 1 turns on fish-eye mode: OGMs that have come
+	// FishEyeHops or more hops from their origin are only rebroadcast for
+	// every FishEyeStride-th SQN. Far away routes converge more slowly, for
+	// much less OGM overhead in large meshes. All nodes should agree on the
+	// settings.
+	FishEyeHops   int
+	FishEyeStride int
+
+	// SenderRate and SenderBurst limit what each sender address may send us:
+	// SenderRate OGMs, or other packets, a second on average, and up to
+	// SenderBurst at once. The rest is dropped.
+	SenderRate  int
+	SenderBurst int
+
+	// A sender of MalformedLimit malformed packets within MalformedWindow is
+	// quarantined: all its packets are dropped for QuarantineTime.
+	MalformedLimit  int
+	MalformedWindow duration
+	QuarantineTime  duration
+
+	// Interfaces holds the rules that select which interfaces to run on, and
+	// with what settings. Each address of an up interface is checked against
+	// the rules in order, and the first matching rule decides. Addresses no
+	// rule matches are used with default settings, unless some rule includes
+	// interfaces, in which case they are left out. Interfaces without
+	// broadcast, such as tunnels, are only used with configured peers.
+	Interfaces []InterfaceRule
+
+	// Route switching hysteresis. A route only moves from a usable next hop
+	// to a better one if the better one beats it by more than SwitchMargin
+	// (in metric units: TQ or kbit/s) and by more than SwitchMarginPercent of
+	// its metric, and if the current next hop has been held for at least
+	// SwitchHoldTime.
+	SwitchMargin        uint32
+	SwitchMarginPercent uint32
+	SwitchHoldTime      duration
+}
+
+// An InterfaceRule matches interface addresses by interface name, address
+// range and interface flags, and either excludes them or gives the settings
+// to use them with. Empty match fields match anything, and zero settings keep
+// the defaults; HopPenalty is a pointer so that a penalty of 0 can be set.
+type InterfaceRule struct {
+	Name    string   // Interface name glob, such as "wlan*"
+	CIDR    string   // Address range, such as "10.0.0.0/8"
+	Flags   []string // Flags that must be set, such as "multicast", or clear, such as "!pointtopoint"
+	Exclude bool     // Leave matching addresses out
+
+	HopPenalty  *byte    // TQ hop penalty for routes through neighbors heard on the interface
+	OGMInterval duration // Minimum time between own OGMs sent on the interface
+	MTU         int      // Largest packet sent on the interface (bytes)
+	Multicast   ipAddr   // Multicast group to join and send to instead of broadcasting, such as "239.255.75.1"
+	Peers       []ipAddr // Addresses to send to by unicast instead of broadcasting, for links without broadcast
+}
+
+// interfaceFlags names the flags InterfaceRule.Flags may test.
+var interfaceFlags = map[string]net.Flags{
+	"up":           net.FlagUp,
+	"broadcast":    net.FlagBroadcast,
+	"loopback":     net.FlagLoopback,
+	"pointtopoint": net.FlagPointToPoint,
+	"multicast":    net.FlagMulticast,
+	"running":      net.FlagRunning,
+}
+
+// validate checks a rule's match fields and settings.
+func (r *InterfaceRule) validate() error {
+	if _, err := path.Match(r.Name, ""); err != nil {
+		return fmt.Errorf("config: interface rule: bad Name glob %q", r.Name)
+	}
+	if r.CIDR != "" {
+		if _, _, err := net.ParseCIDR(r.CIDR); err != nil {
+			return fmt.Errorf("config: interface rule: bad CIDR %q", r.CIDR)
+		}
+	}
+	for _, f := range r.Flags {
+		if _, ok := interfaceFlags[strings.TrimPrefix(f, "!")]; !ok {
+			return fmt.Errorf("config: interface rule: unknown flag %q", f)
+		}
+	}
+	if r.OGMInterval.Duration < 0 {
+		return fmt.Errorf("config: interface rule: OGMInterval must not be negative, got %v", r.OGMInterval)
+	}
+	if ip := net.ParseIP(string(r.Multicast)); r.Multicast != "" && (ip.To4() == nil || !ip.IsMulticast()) {
+		return fmt.Errorf("config: interface rule: Multicast must be an IPv4 multicast group, got %q", r.Multicast)
+	}
+	for _, peer := range r.Peers {
+		if net.ParseIP(string(peer)).To4() == nil {
+			return fmt.Errorf("config: interface rule: peers must be IPv4 addresses, got %q", peer)
+		}
+	}
+	if len(r.Peers) > 0 && r.Multicast != "" {
+		return fmt.Errorf("config: interface rule: Peers and Multicast are mutually exclusive")
+	}
+	if r.MTU != 0 && (r.MTU < batMinMTU || r.MTU > batMaxMTU) {
+		return fmt.Errorf("config: interface rule: MTU must be between %d and %d, got %d", batMinMTU, batMaxMTU, r.MTU)
+	}
+	return nil
+}
+
+// defaultConfig returns the settings used when nothing else is configured.
+func defaultConfig() Config {
+	return Config{
+		Metric:          metricTQ,
+		LinkRates:       make(map[ipAddr]uint32),
+		DefaultLinkRate: batDefaultLinkRate,
+		ProbeInterval:   duration{batProbeInterval * time.Second},
+		HelloInterval:   duration{batHelloInterval * time.Millisecond},
+		OGMInterval:     duration{batOGMInterval * time.Second},
+		MaxOGMInterval:  duration{batMaxOGMInterval * time.Second},
+		WindowSize:      batLocalWindowSize,
+		TQWindowSize:    batTQGlobalWindowSize,
+
+		LinkTimeout:       duration{batLinkTimeout * time.Second},
+		HopTimeout:        duration{batHopTimeout * time.Second},
+		OriginatorTimeout: duration{batOriginatorTimeout * time.Second},
+		PurgeInterval:     duration{batPurgeInterval * time.Second},
+
+		InterfaceScanInterval: duration{batInterfaceScanInterval * time.Second},
+
+		FishEyeHops:   batFishEyeHops,
+		FishEyeStride: 1,
+
+		SenderRate:      batSenderRate,
+		SenderBurst:     batSenderBurst,
+		MalformedLimit:  batMalformedLimit,
+		MalformedWindow: duration{batMalformedWindow * time.Second},
+		QuarantineTime:  duration{batQuarantineTime * time.Second},
+
+		SwitchMargin:        batSwitchMargin,
+		SwitchMarginPercent: batSwitchMarginPercent,
+		SwitchHoldTime:      duration{batSwitchHoldTime * time.Second},
+	}
+}
+
+// loadConfig reads a JSON configuration file on top of the default settings.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, fmt.Errorf("loadConfig: %v", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("loadConfig: %s: %v", path, err)
+	}
+	return cfg, cfg.validate()
+}
+
+// validate checks the settings for values the daemon cannot work with.
+func (cfg *Config) validate() error {
+	switch cfg.Metric {
+	case metricTQ, metricThroughput:
+	default:
+		return fmt.Errorf("config: unknown metric %q", cfg.Metric)
+	}
+	if cfg.PrimaryAddr != "" && net.ParseIP(string(cfg.PrimaryAddr)).To4() == nil {
+		return fmt.Errorf("config: PrimaryAddr must be an IPv4 address, got %q", cfg.PrimaryAddr)
+	}
+	if cfg.ProbeInterval.Duration <= 0 {
+		return fmt.Errorf("config: ProbeInterval must be positive, got %v", cfg.ProbeInterval)
+	}
+	if cfg.HelloInterval.Duration < time.Millisecond || cfg.HelloInterval.Duration > 0xFFFF*time.Millisecond {
+		return fmt.Errorf("config: HelloInterval must be between 1ms and 65.535s, got %v", cfg.HelloInterval)
+	}
+	if cfg.OGMInterval.Duration < time.Millisecond || cfg.OGMInterval.Duration > 0xFFFF*time.Millisecond {
+		return fmt.Errorf("config: OGMInterval must be between 1ms and 65.535s, got %v", cfg.OGMInterval)
+	}
+	if cfg.AdaptiveOGMInterval && (cfg.MaxOGMInterval.Duration < cfg.OGMInterval.Duration || cfg.MaxOGMInterval.Duration > 0xFFFF*time.Millisecond) {
+		return fmt.Errorf("config: MaxOGMInterval must be between OGMInterval and 65.535s, got %v", cfg.MaxOGMInterval)
+	}
+	if cfg.WindowSize < batCutoffRQSamples || cfg.WindowSize < batCutoffEQSamples || cfg.WindowSize > batSQNAddrSize/2 {
+		return fmt.Errorf("config: WindowSize must be between %d and %d, got %d",
+			max(batCutoffRQSamples, batCutoffEQSamples), batSQNAddrSize/2, cfg.WindowSize)
+	}
+	if cfg.TQWindowSize < 1 || cfg.TQWindowSize > batSQNAddrSize/2 {
+		return fmt.Errorf("config: TQWindowSize must be between 1 and %d, got %d", batSQNAddrSize/2, cfg.TQWindowSize)
+	}
+	for name, d := range map[string]duration{
+		"LinkTimeout":           cfg.LinkTimeout,
+		"HopTimeout":            cfg.HopTimeout,
+		"OriginatorTimeout":     cfg.OriginatorTimeout,
+		"PurgeInterval":         cfg.PurgeInterval,
+		"InterfaceScanInterval": cfg.InterfaceScanInterval,
+		"MalformedWindow":       cfg.MalformedWindow,
+		"QuarantineTime":        cfg.QuarantineTime,
+	} {
+		if d.Duration <= 0 {
+			return fmt.Errorf("config: %s must be positive, got %v", name, d)
+		}
+	}
+	if cfg.FishEyeHops < 1 || cfg.FishEyeHops > batTTL {
+		return fmt.Errorf("config: FishEyeHops must be between 1 and %d, got %d", batTTL, cfg.FishEyeHops)
+	}
+	if cfg.FishEyeStride < 1 || cfg.FishEyeStride > batSQNAddrSize {
+		return fmt.Errorf("config: FishEyeStride must be between 1 and %d, got %d", batSQNAddrSize, cfg.FishEyeStride)
+	}
+	if cfg.SenderRate < 1 || cfg.SenderBurst < 1 {
+		return fmt.Errorf("config: SenderRate and SenderBurst must be positive, got %d and %d", cfg.SenderRate, cfg.SenderBurst)
+	}
+	if cfg.MalformedLimit < 1 {
+		return fmt.Errorf("config: MalformedLimit must be positive, got %d", cfg.MalformedLimit)
+	}
+	if cfg.SwitchHoldTime.Duration < 0 {
+		return fmt.Errorf("config: SwitchHoldTime must not be negative, got %v", cfg.SwitchHoldTime)
+	}
+	for i := range cfg.Interfaces {
+		if err := cfg.Interfaces[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// duration is a time.Duration that is written in JSON as a string such as "1.5s".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration: %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("duration: %v", err)
+	}
+	d.Duration = parsed
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+// Duplicate OGM detection
+//
+// An originator's OGM reaches us once through every neighbor that forwards
+// it, and sometimes more than once through the same one. Every copy tells us
+// about a path, so every copy updates the next hop it came through, but only
+// one copy of each SQN is forwarded: the first to arrive through our best
+// next hop towards the originator. A copy arriving again through a link that
+// already delivered its SQN has been around a loop, and is never forwarded.
+//
+// Each originator's dupTracker records, for the recent window of SQNs, the
+// links each SQN arrived through, in the order it did, and whether we
+// forwarded it.
+
+// A dupTracker records the copies of one originator's recent OGMs.
+type dupTracker struct {
+	seen       *bitWindow        // SQNs received through any link
+	forwarded  *bitWindow        // SQNs we forwarded a copy of
+	deliveries map[int][]linkKey // Links each SQN arrived through, first copy first
+}
+
+// A dupResult tells what a received OGM copy is.
+type dupResult struct {
+	copies int  // Copies of the SQN received so far, this one included; 1 for the first copy
+	repeat bool // The SQN already arrived through the same link: the copy has looped
+	stale  bool // The SQN is older than the window, so it cannot be told apart
+}
+
+func newDupTracker(windowSize int) *dupTracker {
+	return &dupTracker{
+		seen:       newBitWindow(batSQNAddrSize, windowSize),
+		forwarded:  newBitWindow(batSQNAddrSize, windowSize),
+		deliveries: make(map[int][]linkKey),
+	}
+}
+
+// record records a copy of the SQN received through the given link, and
+// tells what the copy is.
+func (d *dupTracker) record(sqn sqn, key linkKey) dupResult {
+	if !d.seen.inWindow(sqn.num) {
+		if d.seen.countHits() > 0 && !d.ahead(sqn.num) {
+			return dupResult{stale: true}
+		}
+		d.seen.write(sqn.num)
+		d.forwarded.write(sqn.num)
+	}
+
+	links := d.delivered(sqn)
+	for _, prev := range links {
+		if prev == key {
+			return dupResult{copies: len(links) + 1, repeat: true}
+		}
+	}
+	if len(d.deliveries) > 2*d.seen.windowSize {
+		for num := range d.deliveries {
+			if !d.seen.inWindow(num) {
+				delete(d.deliveries, num)
+			}
+		}
+	}
+	d.seen.write(sqn.num, true)
+	d.deliveries[sqn.num] = append(links, key)
+	return dupResult{copies: len(links) + 1}
+}
+
+// ahead reports whether the SQN lies ahead of the window.
+func (d *dupTracker) ahead(num int) bool {
+	ahead := pmod(num-d.seen.addressHead, d.seen.addressSize)
+	return ahead > 0 && ahead < d.seen.addressSize/2
+}
+
+// delivered returns the links the SQN arrived through, first copy first.
+func (d *dupTracker) delivered(sqn sqn) []linkKey {
+	if hit, _ := d.seen.read(sqn.num); !hit {
+		return nil // Left over from an earlier pass through the address space
+	}
+	return d.deliveries[sqn.num]
+}
+
+// markForwarded records that a copy of the SQN was forwarded.
+func (d *dupTracker) markForwarded(sqn sqn) {
+	if d.forwarded.inWindow(sqn.num) {
+		d.forwarded.write(sqn.num, true)
+	}
+}
+
+// wasForwarded reports whether a copy of the SQN was forwarded.
+func (d *dupTracker) wasForwarded(sqn sqn) bool {
+	hit, _ := d.forwarded.read(sqn.num)
+	return hit
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDupTracker(t *testing.T) {
+	d := newDupTracker(8)
+	n2, n3 := testLink("10.0.0.2"), testLink("10.0.0.3")
+
+	if dup := d.record(newDefaultSQN(100), n2); dup.copies != 1 || dup.repeat || dup.stale {
+		t.Error("dupTracker: first copy:", dup)
+	}
+	if dup := d.record(newDefaultSQN(100), n3); dup.copies != 2 || dup.repeat {
+		t.Error("dupTracker: duplicate copy:", dup)
+	}
+	if dup := d.record(newDefaultSQN(100), n2); !dup.repeat {
+		t.Error("dupTracker: looped copy not told:", dup)
+	}
+	if links := d.delivered(newDefaultSQN(100)); len(links) != 2 || links[0] != n2 || links[1] != n3 {
+		t.Error("dupTracker: wrong deliveries:", links)
+	}
+
+	// Late SQNs within the window are tracked, older ones are stale.
+	if dup := d.record(newDefaultSQN(95), n3); dup.copies != 1 || dup.stale {
+		t.Error("dupTracker: late first copy:", dup)
+	}
+	if dup := d.record(newDefaultSQN(90), n3); !dup.stale {
+		t.Error("dupTracker: copy older than the window:", dup)
+	}
+
+	// Forwarding is remembered until the SQN leaves the window, also when
+	// the SQNs roll over.
+	d.markForwarded(newDefaultSQN(100))
+	if !d.wasForwarded(newDefaultSQN(100)) || d.wasForwarded(newDefaultSQN(95)) {
+		t.Error("dupTracker: wrong SQNs forwarded")
+	}
+	for num := 101; num < 100+batSQNAddrSize; num++ {
+		d.record(newDefaultSQN(num%batSQNAddrSize), n2)
+	}
+	if dup := d.record(newDefaultSQN(100), n3); dup.copies != 1 || d.wasForwarded(newDefaultSQN(100)) {
+		t.Error("dupTracker: SQN remembered from the last roll over:", dup)
+	}
+	if len(d.deliveries) > 2*8+1 {
+		t.Error("dupTracker: deliveries not pruned:", len(d.deliveries))
+	}
+}
+
+func TestForwardFirstCopy(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SwitchHoldTime.Duration = 0
+	b := New(cfg)
+	n2, n3 := linkKey{"10.0.0.1", "10.0.0.2"}, linkKey{"10.0.0.1", "10.0.0.3"}
+	b.originators.link("N2", n2).tq = batTQMaxValue
+	b.originators.link("N3", n3).tq = batTQMaxValue
+	receive := func(sender nodeID, key linkKey, num int, quality byte) {
+		b.processAndForward(OGM{Origin: "D", Sender: sender, RxAddr: key.iface, TxAddr: key.addr,
+			SQN: newDefaultSQN(num), TTL: batTTL, Quality: quality, RxTime: time.Now()})
+	}
+	forwarded := func() int {
+		depth, _, _ := b.outbound.stats()
+		return depth
+	}
+
+	// The first copy through the best next hop is forwarded; copies through
+	// another neighbor and looped copies are not.
+	receive("N2", n2, 1, 200)
+	receive("N3", n3, 1, 100)
+	receive("N2", n2, 1, 200)
+	if n := forwarded(); n != 1 {
+		t.Error("processAndForward: wrong copies forwarded:", n)
+	}
+	if b.originators.duplicates != 2 || b.originators.loops != 1 {
+		t.Error("processAndForward: wrong duplicate counts:", b.originators.duplicates, b.originators.loops)
+	}
+
+	// The best next hop's copy is forwarded even if it arrives second, but
+	// only once.
+	receive("N3", n3, 2, 100)
+	receive("N2", n2, 2, 200)
+	receive("N2", n2, 2, 200)
+	if n := forwarded(); n != 2 {
+		t.Error("processAndForward: best next hop's copy not forwarded once:", n)
+	}
+}
+
+func TestForwardNeighborOnce(t *testing.T) {
+	b := New(defaultConfig())
+	n2, n2b := linkKey{"10.0.0.1", "10.0.0.2"}, linkKey{"10.1.0.1", "10.0.0.2"}
+	b.originators.link("N2", n2).tq = batTQMaxValue
+	b.originators.link("N2", n2b).tq = batTQMaxValue
+	receive := func(key linkKey, num int) {
+		b.processAndForward(OGM{Origin: "N2", Sender: "N2", RxAddr: key.iface, TxAddr: key.addr,
+			SQN: newDefaultSQN(num), TTL: batTTL, Quality: batTQMaxValue, RxTime: time.Now()})
+	}
+	forwarded := func() int {
+		depth, _, _ := b.outbound.stats()
+		return depth
+	}
+
+	// A neighbor heard on two of our interfaces is forwarded once per SQN.
+	receive(n2, 100)
+	receive(n2b, 100)
+	receive(n2, 100)
+	if n := forwarded(); n != 1 {
+		t.Error("processAndForward: neighbor OGM not forwarded once:", n)
+	}
+
+	// Stale copies, older than the window, are not forwarded.
+	receive(n2, 10)
+	if n := forwarded(); n != 1 {
+		t.Error("processAndForward: stale neighbor OGM forwarded:", n)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Echo Location Protocol (ELP)
+//
+// Neighbor discovery and link sensing use their own one-hop hello packets,
+// sent on every interface at a faster interval than OGMs and never forwarded.
+// Received hellos drive the RQ window of the link they arrived on. Each hello
+// also lists the neighbor link addresses its sender hears on that interface,
+// together with the latest hello SQN heard from each. Finding our own address
+// in that list echoes our hello back to us, which drives the link's EQ window.
+// OGMs then only serve to propagate routes.
+//
+// Links are kept per pair of our interface and neighbor address. An echo is
+// credited to the link from the interface whose address was echoed, since
+// that is the interface the echoed hello was sent on.
+
+// A RawHello is the fixed part of an ELP hello packet. It is followed on the
+// wire by Count RawHelloNeighbor entries.
+type RawHello struct {
+	Type     byte    // batPacketHello
+	Sender   [4]byte // nodeID of the hello's sender
+	SQN      uint32  // Hello sequence number
+	Interval uint16  // Sender's hello interval (milliseconds)
+	Count    byte    // Number of RawHelloNeighbor entries that follow
+}
+
+// A RawHelloNeighbor reports one neighbor link heard by a hello's sender.
+type RawHelloNeighbor struct {
+	Addr [4]byte // Neighbor link address (ipAddr)
+	SQN  uint32  // Latest hello SQN heard from Addr
+}
+
+// hello is an ELP hello converted to internal package types, together with
+// the addressing it was received with.
+type hello struct {
+	sender    nodeID
+	sqn       sqn
+	interval  time.Duration
+	neighbors map[ipAddr]sqn
+
+	srcAddr ipAddr // Sender's link address
+	rxAddr  ipAddr // Our own address the hello was received on
+	rxTime  time.Time
+}
+
+func packHello(buf *[]byte, h RawHello, neighbors []RawHelloNeighbor) error {
+	if len(neighbors) > batMaxHelloNeighbors {
+		return fmt.Errorf("packHello: too many neighbors: %d > %d", len(neighbors), batMaxHelloNeighbors)
+	}
+	h.Count = byte(len(neighbors))
+
+	buffer := bytes.NewBuffer((*buf)[:0])
+	if err := binary.Write(buffer, binary.LittleEndian, h); err != nil {
+		return fmt.Errorf("packHello: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, neighbors); err != nil {
+		return fmt.Errorf("packHello: %v", err)
+	}
+	*buf = buffer.Bytes()
+	return nil
+}
+
+func parseHello(pkt []byte, d datagram) (hello, error) {
+	raw := RawHello{}
+	headerSize := binary.Size(raw)
+	if len(pkt) < headerSize {
+		return hello{}, fmt.Errorf("parseHello: malformed hello of %d bytes", len(pkt))
+	}
+	b := bytes.NewReader(pkt)
+	binary.Read(b, binary.LittleEndian, &raw)
+
+	neighbors := make([]RawHelloNeighbor, raw.Count)
+	if len(pkt) != headerSize+len(neighbors)*binary.Size(RawHelloNeighbor{}) {
+		return hello{}, fmt.Errorf("parseHello: invalid count value %d for %d bytes", raw.Count, len(pkt))
+	}
+	binary.Read(b, binary.LittleEndian, neighbors)
+
+	h := hello{
+		sender:    nodeIDFromBytes(raw.Sender),
+		sqn:       newDefaultSQN(int(raw.SQN % batSQNAddrSize)),
+		interval:  time.Duration(raw.Interval) * time.Millisecond,
+		neighbors: make(map[ipAddr]sqn, len(neighbors)),
+		srcAddr:   d.srcAddr,
+		rxAddr:    d.rxAddr,
+		rxTime:    d.rxTime,
+	}
+	for _, n := range neighbors {
+		h.neighbors[ipAddrFromBytes(n.Addr)] = newDefaultSQN(int(n.SQN % batSQNAddrSize))
+	}
+	return h, nil
+}
+
+// helloNeighborsFit returns how many neighbor entries fit in a hello of at
+// most mtu bytes.
+func helloNeighborsFit(mtu int) int {
+	fit := (mtu - binary.Size(RawHello{})) / binary.Size(RawHelloNeighbor{})
+	return min(fit, batMaxHelloNeighbors)
+}
+
+// sendHellos broadcasts one hello on each interface, listing the neighbor
+// links recently heard on that interface.
+func (b *Batman) sendHellos() {
+	b.helloSQN.increment()
+	msg := make([]byte, 0, batSafePacketSize)
+
+	for ip, iface := range b.ifaces {
+		maxNeighbors := helloNeighborsFit(iface.info.settings.mtu)
+		neighbors := make([]RawHelloNeighbor, 0, maxNeighbors)
+		b.originators.forEachLink(func(id nodeID, key linkKey, link *linkData) {
+			if key.iface != ip || len(neighbors) >= maxNeighbors {
+				return
+			}
+			if time.Since(link.heard) > time.Duration(b.cfg.WindowSize)*b.cfg.HelloInterval.Duration {
+				return
+			}
+			neighbors = append(neighbors, RawHelloNeighbor{key.addr.raw(), link.helloSQN.raw()})
+		})
+
+		h := RawHello{
+			Type:     batPacketHello,
+			Sender:   b.id.raw(),
+			SQN:      b.helloSQN.raw(),
+			Interval: uint16(b.cfg.HelloInterval.Duration / time.Millisecond),
+		}
+		if err := packHello(&msg, h, neighbors); err != nil {
+			continue
+		}
+		_ = iface.broadcast(msg)
+	}
+}
+
+// processHello updates neighbor and link state from a received hello.
+// Hellos are never forwarded.
+func (b *Batman) processHello(h hello) {
+	if h.sender == b.id {
+		return
+	}
+	if !b.originators.acceptClaim(h.sender, h.srcAddr, h.rxTime) {
+		return
+	}
+	key := linkKey{h.rxAddr, h.srcAddr}
+	link := b.originators.link(h.sender, key)
+	links := b.originators.get(h.sender).links
+
+	// Receiving the hello samples the link's RQ.
+	links.markReceive(key, h.sqn, h.rxTime)
+	link.helloSQN = h.sqn
+	link.interval = h.interval
+
+	// Finding one of our addresses in the hello's neighbor list echoes the
+	// hello we sent from that address, which samples the EQ of our link from
+	// there to the sender. Addresses we have no such link for are not ours, or
+	// belong to an interface the sender is not heard on.
+	for addr, echoed := range h.neighbors {
+		if echoKey := (linkKey{addr, h.srcAddr}); links[echoKey] != nil {
+			links.markEcho(echoKey, echoed, h.rxTime)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPackParseHello(t *testing.T) {
+	raw := RawHello{Type: batPacketHello, Sender: [4]byte{0, 0, 'L', '2'}, SQN: 42, Interval: 500}
+	neighbors := []RawHelloNeighbor{
+		{[4]byte{10, 0, 0, 1}, 40},
+		{[4]byte{10, 0, 0, 3}, 41},
+	}
+	b := make([]byte, 0, batSafePacketSize)
+	if err := packHello(&b, raw, neighbors); err != nil {
+		t.Error("hello error: packing:", err)
+	}
+	h, err := parseHello(b, datagram{srcAddr: "10.0.0.2", rxAddr: "10.0.0.1"})
+	if err != nil {
+		t.Error("hello error: parsing:", err)
+	}
+	if h.sender != "L2" || !h.sqn.equalTo(newDefaultSQN(42)) || h.interval != 500*time.Millisecond {
+		t.Error("hello error: packing and parsing inconsistency:", h)
+	}
+	if s, ok := h.neighbors["10.0.0.3"]; !ok || !s.equalTo(newDefaultSQN(41)) || len(h.neighbors) != 2 {
+		t.Error("hello error: neighbor list inconsistency:", h.neighbors)
+	}
+
+	if _, err := parseHello(b[:len(b)-1], datagram{}); err == nil {
+		t.Error("hello error: truncated hello accepted")
+	}
+	if err := packHello(&b, raw, make([]RawHelloNeighbor, batMaxHelloNeighbors+1)); err == nil {
+		t.Error("hello error: oversized neighbor list accepted")
+	}
+	if err := packHello(&b, raw, make([]RawHelloNeighbor, batMaxHelloNeighbors)); err != nil || len(b) > batSafePacketSize {
+		t.Error("hello error: full hello does not fit a safe packet:", len(b), err)
+	}
+	if helloNeighborsFit(batSafePacketSize) != batMaxHelloNeighbors {
+		t.Error("hello error: safe packet does not fit a full hello")
+	}
+	fit := helloNeighborsFit(batMinMTU)
+	if err := packHello(&b, raw, make([]RawHelloNeighbor, fit)); err != nil || len(b) > batMinMTU || fit < 1 {
+		t.Error("hello error: hello does not fit the smallest MTU:", fit, len(b), err)
+	}
+}
+
+func TestProcessHello(t *testing.T) {
+	b := New(defaultConfig())
+	now := time.Now()
+
+	// A neighbor that hears us and echoes all of our hellos
+	for i := 0; i < batLocalWindowSize; i++ {
+		b.processHello(hello{
+			sender:    "N2",
+			sqn:       newDefaultSQN(i),
+			interval:  batHelloInterval * time.Millisecond,
+			neighbors: map[ipAddr]sqn{"10.0.0.1": newDefaultSQN(i)},
+			srcAddr:   "10.0.0.2",
+			rxAddr:    "10.0.0.1",
+			rxTime:    now,
+		})
+	}
+	_, link, ok := b.originators.linkTo(testLink("10.0.0.2"))
+	if !ok {
+		t.Fatal("processHello: neighbor link not created")
+	}
+	if link.tq != batTQMaxValue {
+		t.Error("processHello: perfect link not detected:", link)
+	}
+
+	// A neighbor that we hear, but which does not hear us
+	for i := 0; i < batLocalWindowSize; i++ {
+		b.processHello(hello{
+			sender:    "N3",
+			sqn:       newDefaultSQN(i),
+			neighbors: map[ipAddr]sqn{},
+			srcAddr:   "10.0.0.3",
+			rxAddr:    "10.0.0.1",
+			rxTime:    now,
+		})
+	}
+	if _, link, _ := b.originators.linkTo(testLink("10.0.0.3")); link.tq != 0 {
+		t.Error("processHello: one-way link has TQ:", link)
+	}
+}
+
+func TestProcessHelloMultiInterface(t *testing.T) {
+	b := New(defaultConfig())
+	now := time.Now()
+
+	// A neighbor heard on two of our interfaces, which only hears us on the
+	// first. Its hellos on both interfaces list the first interface's address.
+	for i := 0; i < batLocalWindowSize; i++ {
+		for _, rx := range []ipAddr{"10.0.0.1", "10.1.0.1"} {
+			b.processHello(hello{
+				sender:    "N2",
+				sqn:       newDefaultSQN(i),
+				neighbors: map[ipAddr]sqn{"10.0.0.1": newDefaultSQN(i)},
+				srcAddr:   "10.0.0.2",
+				rxAddr:    rx,
+				rxTime:    now,
+			})
+		}
+	}
+	_, first, ok := b.originators.linkTo(linkKey{"10.0.0.1", "10.0.0.2"})
+	if !ok || first.tq != batTQMaxValue {
+		t.Error("processHello: echoed link not detected:", first)
+	}
+	_, second, ok := b.originators.linkTo(linkKey{"10.1.0.1", "10.0.0.2"})
+	if !ok || second.tq != 0 {
+		t.Error("processHello: echo credited to the wrong interface:", second)
+	}
+}
+
+func TestProcessHelloKnownAddress(t *testing.T) {
+	b := New(defaultConfig())
+	now := time.Now()
+	claim := func(sender nodeID, num int, when time.Time) {
+		b.processHello(hello{
+			sender:    sender,
+			sqn:       newDefaultSQN(num),
+			neighbors: map[ipAddr]sqn{},
+			srcAddr:   "10.0.0.2",
+			rxAddr:    "10.0.0.1",
+			rxTime:    when,
+		})
+	}
+	claim("N2", 1, now)
+
+	// A hello from N2's address that claims another sender is ignored while
+	// N2 is heard there, and does not take the link over.
+	claim("N9", 100, now.Add(time.Second))
+	if id, link, ok := b.originators.linkTo(testLink("10.0.0.2")); !ok || id != "N2" || link.helloSQN != newDefaultSQN(1) {
+		t.Error("processHello: link taken over by a claimed sender:", id, link)
+	}
+
+	// Once N2 has been silent there for LinkTimeout, the claim wins.
+	claim("N9", 101, now.Add(b.cfg.LinkTimeout.Duration+time.Second))
+	if id, _, ok := b.originators.linkTo(testLink("10.0.0.2")); !ok || id != "N9" {
+		t.Error("processHello: address not taken over after the owner's silence:", id)
+	}
+	if owner, _ := b.originators.originatorOf("10.0.0.2"); owner != "N9" || b.originators.isNeighbor("N2") {
+		t.Error("processHello: address still with its old owner:", owner)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+)
+
+// Fish-eye rebroadcasts
+//
+// Every OGM floods the whole mesh, so OGM overhead grows with the square of
+// the number of nodes. In fish-eye mode, nodes far away are heard less
+// often: an OGM that has come FishEyeHops or more hops from its origin is
+// only rebroadcast if its SQN is a multiple of FishEyeStride. Routes to far
+// away nodes then take longer to converge, but they still do, and near ones
+// are as fresh as ever. All nodes of a mesh should agree on the settings.
+//
+// The node at the edge of the near scope, whose rebroadcasts are the first
+// to be thinned, multiplies the OGM interval the OGM advertises by the
+// stride, so that nodes further out expect the origin's OGMs at the pace
+// they actually come, and do not time out its routes.
+
+// fishEyeDistance returns how many hops a received OGM has come from its
+// origin.
+func fishEyeDistance(ogm OGM) int {
+	return batTTL - int(ogm.TTL) + 1
+}
+
+// thin decides whether a received OGM is to be rebroadcast in fish-eye mode,
+// and adapts the interval it advertises. It counts the OGMs it thins out.
+func (b *Batman) thin(ogm *OGM) bool {
+	stride, hops := b.cfg.FishEyeStride, b.cfg.FishEyeHops
+	distance := fishEyeDistance(*ogm)
+	if stride <= 1 || distance < hops {
+		return true
+	}
+	if ogm.SQN.num%stride != 0 {
+		b.thinned++
+		return false
+	}
+	if distance == hops && ogm.Interval > 0 {
+		ogm.Interval = time.Duration(min(int(ogm.Interval)*stride, int(0xFFFF*time.Millisecond)))
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFishEyeThinning(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.FishEyeHops = 3
+	cfg.FishEyeStride = 4
+	b := New(cfg)
+	forward := func(distance, num int) (OGM, bool) {
+		b.rebroadcast(OGM{Origin: "D", Sender: "N2", SQN: newDefaultSQN(num), TTL: byte(batTTL - distance + 1),
+			Quality: batTQMaxValue, Interval: time.Second})
+		ogms := b.outbound.take(nil, 10)
+		if len(ogms) == 0 {
+			return OGM{}, false
+		}
+		return ogms[0], true
+	}
+
+	// Near OGMs all go on.
+	for num := 1; num <= 4; num++ {
+		if ogm, ok := forward(2, num); !ok || ogm.Interval != time.Second {
+			t.Error("rebroadcast: near OGM thinned:", num, ogm)
+		}
+	}
+
+	// From the edge on, only every fourth SQN does, and the edge advertises
+	// the pace it goes at.
+	for num := 1; num <= 4; num++ {
+		ogm, ok := forward(3, num)
+		if ok != (num == 4) {
+			t.Error("rebroadcast: wrong SQN thinned at the edge:", num, ok)
+		}
+		if ok && ogm.Interval != 4*time.Second {
+			t.Error("rebroadcast: interval not scaled at the edge:", ogm.Interval)
+		}
+	}
+	if ogm, ok := forward(6, 8); !ok || ogm.Interval != time.Second {
+		t.Error("rebroadcast: interval scaled beyond the edge:", ogm, ok)
+	}
+	if b.thinned != 3 {
+		t.Error("rebroadcast: wrong thinned count:", b.thinned)
+	}
+
+	// Switched off, nothing is thinned.
+	b.cfg.FishEyeStride = 1
+	if _, ok := forward(10, 1); !ok {
+		t.Error("rebroadcast: thinned with fish-eye mode off")
+	}
+}
+
+func TestFishEyeRouteHolds(t *testing.T) {
+	cfg := defaultConfig()
+	table := newOriginatorTable("L1", &cfg)
+	key := testLink("10.0.0.2")
+	table.link("N2", key).tq = batTQMaxValue
+
+	// A far node hears every eighth of D's OGMs, at the pace the edge of the
+	// near scope advertises; its route to D holds all along.
+	const stride = 8
+	now := time.Now()
+	for num := 0; num < 10*stride; num++ {
+		if num%stride == 0 {
+			table.updatePath("D", key, newDefaultSQN(num), 200, 0, now)
+			table.advertised("D", newDefaultSQN(num), stride*time.Second)
+		}
+		now = now.Add(time.Second)
+		table.get("D").decayHops(now)
+		table.refreshRoutes(now)
+		if _, ok := table.route("D"); !ok {
+			t.Fatal("fish-eye: far route lost between thinned OGMs at SQN", num)
+		}
+	}
+}
@@ -7,12 +7,14 @@ import "time"
 func (b *Batman) processAndForward(ogm OGM) {
 
 	// Facts for Deciding Case Statement //
-	_, sentByNeighbor := b.neighbors[ogm.Sender] // The OGM was sent by one of our known neighbors
-	_, viaKnownLink := b.neighbors[ogm.Sender]   // The OGM sent by a neighbor's known link address
-	//ToDo(Sean): Eventually update viaKnownLink to track link-address spesific information to allow multi-interface
-
-	// General Facts //
-	_, knownNode := b.nodes[ogm.Origin] // An OGM from this node has been seen before.
+	viaLink := linkKey{ogm.RxAddr, ogm.TxAddr} // The link the OGM arrived on: our interface and the sender's address
+	linkOwner, _, linked := b.originators.linkTo(viaLink)
+	sentByNeighbor := b.originators.isNeighbor(ogm.Sender) // The OGM was sent by one of our known neighbors
+	viaKnownLink := linked && linkOwner == ogm.Sender      // The OGM sent by a neighbor's known link address, heard on the same interface
+	rxTime := ogm.RxTime                                   // When the OGM arrived; when we got to it if not known
+	if rxTime.IsZero() {
+		rxTime = time.Now()
+	}
 
 	// Possible Routing Cases //
 	switch {
@@ -22,48 +24,31 @@ func (b *Batman) processAndForward(ogm OGM) {
 
 	// My OGM Echo Case:
 	case ogm.Origin == b.id && ogm.PrevSender == b.id && sentByNeighbor && viaKnownLink:
-		// My OGM has been echoed by a known neighbor via a known link, and so may be used to
-		// update my estimate of link quality.
+		// My OGM has been echoed by a known neighbor via a known link. Link quality is sensed
+		// by ELP hellos, so there is nothing to learn from it.
 		// I shall NOT rebroadcast this OGM.
 
-		// ToDo(Sean): Add SQN check
-
-		// Useful Facts //
-		directLink := ogm.RxAddr == ogm.PrevAddr // OGM send and received on same link; EQ and RQ are compatible for estimating TQ.
-		var directIP ipAddr
-		if directLink {
-			directIP = ogm.TxAddr
-		}
-
-		// Update Metrics //
-		b.neighbors[ogm.Sender].markEcho(directIP, ogm.SQN, time.Now()) // ToDo(Sean): Add timestamp to OGM using actual received time.
-
 	// Neighbor OGM Case:
-	case ogm.Sender == ogm.Origin && ogm.Origin != b.id:
-		// The OGM is from a neighbor (1-hop link). It informs me of the node's existence and will
-		// be used to update my estimate of our link quality (RQ).
+	case ogm.Sender == ogm.Origin && ogm.Origin != b.id && sentByNeighbor && viaKnownLink:
+		// The OGM is from a neighbor (1-hop link) already discovered by ELP. It offers a direct
+		// route to the node, whose quality depends on our link to it.
 		// I shall rebroadcast this OGM.
 
-		// Useful Facts //
-		_, knownNeighbor := b.neighbors[ogm.Origin] // The node is already a known neighbor.
-		// ToDo(Sean): Handle checking and updating based on known/new link
-		// knownLink := false
-		// if knownNeighbor {
-		// 	_, knownLink = b.neighbors[ogm.Origin][ogm.TxAddr] // The current link has been seen before.
-		// }
-
 		// Update Metrics //
-		if !knownNode {
-			b.nodes[ogm.Origin] = newRouteTracker()
-		}
-		if !knownNeighbor {
-			b.neighbors[ogm.Origin] = newNodeLinkMap()
-		}
-		b.neighbors[ogm.Origin].markReceive(ogm.TxAddr, ogm.SQN, time.Now())     // Perform link metric update
-		b.nodes[ogm.Origin].update(ogm.TxAddr, ogm.SQN, ogm.Quality, time.Now()) // Update next-hop node data
+		dup := b.originators.recordCopy(ogm.Origin, viaLink, ogm.SQN)                               // Count duplicate copies
+		b.originators.announce(ogm.Origin, ogm.OriginAddr)                                          // Tie the node's addresses together
+		b.originators.updatePath(ogm.Origin, viaLink, ogm.SQN, ogm.Quality, ogm.Throughput, rxTime) // Update next-hop node data
+		b.originators.advertised(ogm.Origin, ogm.SQN, ogm.Interval)                                 // Track the node's OGM interval
+
+		// Useful Facts //
+		alreadyForwarded := dup.repeat || dup.stale || b.originators.wasForwarded(ogm.Origin, ogm.SQN) // Only the first copy is forwarded,
+		//                                                                                                 whichever link it came through.
 
 		// Rebroadcast //
-		b.rebroadcast(ogm) // Always rebroadcast a neighbor OGM
+		if !alreadyForwarded {
+			b.originators.markForwarded(ogm.Origin, ogm.SQN)
+			b.rebroadcast(ogm) // Those from the neighbor's secondary interfaces expire here
+		}
 
 	// Distant OGM Case:
 	case ogm.Sender != ogm.Origin && ogm.Origin != b.id && ogm.Sender != b.id && sentByNeighbor && viaKnownLink:
@@ -74,24 +59,25 @@ func (b *Batman) processAndForward(ogm OGM) {
 		// is a known neighbor.
 		// I might rebroadcast this OGM.
 
-		// ToDo(Sean): Critical: Finish writing distant OGM case forwarding logic
+		// Update Metrics //
+		dup := b.originators.recordCopy(ogm.Origin, viaLink, ogm.SQN)                               // Count duplicate copies
+		b.originators.announce(ogm.Origin, ogm.OriginAddr)                                          // Tie the node's addresses together
+		b.originators.updatePath(ogm.Origin, viaLink, ogm.SQN, ogm.Quality, ogm.Throughput, rxTime) // Update next-hop node data
+		b.originators.advertised(ogm.Origin, ogm.SQN, ogm.Interval)                                 // Track the node's OGM interval
 
 		// Useful Facts //
-		// bestHop, knownRoute := b.routingTable[ogm.Origin]
-		// // from_best_route # We only forward distant OGMs
-		// //                 # if they arrived to us via our
-		// //                 # best next hop route back to
-		// //                 # the origin.
-		// if knownRoute && ogm.TxAddr == bestHop.ip {
-		// 	fromBestRoute := true
-		// } else {
-		// 	fromBestRoute := false
-		// }
-		// potentialBroadcastLoop := ogm.PrevSender == b.id // We have already broadcast this OGM in the recent past.
-
-		// Update Metrics //
+		bestHop, knownRoute := b.originators.route(ogm.Origin)
+		fromBestRoute := knownRoute && viaLink == bestHop.link // We only forward distant OGMs if they arrived to us
+		//                                                        via our best next hop route back to the origin.
+		potentialBroadcastLoop := ogm.PrevSender == b.id || dup.repeat // We have already broadcast this OGM in the recent past,
+		//                                                                or it has come around a loop.
+		alreadyForwarded := dup.stale || b.originators.wasForwarded(ogm.Origin, ogm.SQN) // Only the first copy via the best route is forwarded.
 
 		// Rebroadcast //
+		if fromBestRoute && !potentialBroadcastLoop && !alreadyForwarded {
+			b.originators.markForwarded(ogm.Origin, ogm.SQN)
+			b.rebroadcast(ogm)
+		}
 
 	// Do Nothging Case:
 	default:
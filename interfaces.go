@@ -0,0 +1,495 @@
+package main
+
+import (
+	"log"
+	"net"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Interfaces come and go while the daemon runs: radios are hot-plugged, and
+// Wi-Fi may only come up well after boot. The OGM handler loop rescans the
+// local addresses every InterfaceScanInterval, opening a socket and starting
+// a listener and a broadcaster for each new address, and tearing them down
+// for each address that disappeared. Links heard on a removed interface are
+// purged along with it.
+//
+// Which addresses are used, and with what settings, is up to the configured
+// interface rules.
+
+// An ifaceInfo describes a local interface address found by a scan, with the
+// settings selected for it.
+type ifaceInfo struct {
+	name     string
+	index    int
+	bcast    net.IP
+	settings ifaceSettings
+}
+
+// ifaceSettings are the effective per-interface settings, defaults filled in.
+type ifaceSettings struct {
+	hopPenalty  byte
+	ogmInterval time.Duration // 0 sends every own OGM
+	mtu         int
+	group       ipAddr   // Multicast group to send to; broadcast if empty
+	peers       []ipAddr // Peers to send to by unicast, instead of broadcast or multicast
+}
+
+func (s ifaceSettings) equal(other ifaceSettings) bool {
+	if len(s.peers) != len(other.peers) {
+		return false
+	}
+	for i := range s.peers {
+		if s.peers[i] != other.peers[i] {
+			return false
+		}
+	}
+	return s.hopPenalty == other.hopPenalty && s.ogmInterval == other.ogmInterval && s.mtu == other.mtu && s.group == other.group
+}
+
+func defaultIfaceSettings() ifaceSettings {
+	return ifaceSettings{hopPenalty: batTQHopPenalty, mtu: batSafePacketSize}
+}
+
+// settings returns the rule's settings with defaults filled in.
+func (r *InterfaceRule) settings() ifaceSettings {
+	s := defaultIfaceSettings()
+	if r.HopPenalty != nil {
+		s.hopPenalty = *r.HopPenalty
+	}
+	if r.MTU != 0 {
+		s.mtu = r.MTU
+	}
+	s.ogmInterval = r.OGMInterval.Duration
+	s.group = r.Multicast
+	s.peers = r.Peers
+	return s
+}
+
+// matches reports whether an address of the named interface meets all of the
+// rule's match fields.
+func (r *InterfaceRule) matches(name string, ip net.IP, flags net.Flags) bool {
+	if r.Name != "" {
+		if ok, _ := path.Match(r.Name, name); !ok {
+			return false
+		}
+	}
+	if r.CIDR != "" {
+		if _, ipnet, err := net.ParseCIDR(r.CIDR); err != nil || !ipnet.Contains(ip) {
+			return false
+		}
+	}
+	for _, f := range r.Flags {
+		set := flags&interfaceFlags[strings.TrimPrefix(f, "!")] != 0
+		if set == strings.HasPrefix(f, "!") {
+			return false
+		}
+	}
+	return true
+}
+
+// selectInterface applies the interface rules to an address of the named
+// interface, returning whether to use it and with what settings.
+func selectInterface(rules []InterfaceRule, name string, ip net.IP, flags net.Flags) (ifaceSettings, bool) {
+	for i := range rules {
+		if rules[i].matches(name, ip, flags) {
+			return rules[i].settings(), !rules[i].Exclude
+		}
+	}
+	for i := range rules {
+		if !rules[i].Exclude {
+			return ifaceSettings{}, false
+		}
+	}
+	return defaultIfaceSettings(), true
+}
+
+// scanInterfaces finds the local IPv4 addresses of up, non-loopback
+// interfaces that the rules select, with their UDP broadcast addresses and
+// settings. Interfaces without broadcast are only of use with peers.
+func scanInterfaces(rules []InterfaceRule) map[ipAddr]ifaceInfo {
+	found := make(map[ipAddr]ifaceInfo)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Println("scanInterfaces:", err)
+		return found
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			bcastIP, err := bcastAddr(ipnet)
+			if err != nil {
+				continue
+			}
+			settings, use := selectInterface(rules, iface.Name, ipnet.IP, iface.Flags)
+			if !use || iface.Flags&net.FlagBroadcast == 0 && len(settings.peers) == 0 {
+				continue
+			}
+			found[ipAddr(ipnet.IP.String())] = ifaceInfo{iface.Name, iface.Index, bcastIP, settings}
+		}
+	}
+	return found
+}
+
+// A netInterface is one local interface address in use, with its socket and
+// the channel that feeds its OGM broadcaster.
+type netInterface struct {
+	addr           ipAddr
+	info           ifaceInfo
+	conn           *net.UDPConn
+	broadcast      func([]byte) error
+	broadcastBatch func([][]byte) error // Set with batched I/O
+	groupConn      *net.UDPConn         // Receives the multicast group in per address mode
+	packets        chan *[]byte         // OGM bundle packets for the broadcaster
+	packetDrops    atomic.Uint64        // Packets dropped with packets full
+	primary        atomic.Bool          // Own OGMs are flooded with full TTL only on the primary interface
+}
+
+// broadcastAll broadcasts several packets on the interface, with a single
+// system call if batched I/O is on.
+func (iface *netInterface) broadcastAll(pkts [][]byte) error {
+	if iface.broadcastBatch != nil {
+		return iface.broadcastBatch(pkts)
+	}
+	var firstErr error
+	for _, pkt := range pkts {
+		if err := iface.broadcast(pkt); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// An ifaceEvent adds an interface to the OGM bundler, or removes it if iface
+// is nil.
+type ifaceEvent struct {
+	addr  ipAddr
+	iface *netInterface
+}
+
+// interfaceChanges compares the interfaces in use with the addresses found by
+// a scan. An address whose interface, broadcast address or settings changed
+// is both removed and added, so that it starts over with the new ones.
+func interfaceChanges(current map[ipAddr]*netInterface, found map[ipAddr]ifaceInfo) (added, removed []ipAddr) {
+	for addr, iface := range current {
+		if info, ok := found[addr]; !ok || !info.equal(iface.info) {
+			removed = append(removed, addr)
+		}
+	}
+	for addr, info := range found {
+		if iface, ok := current[addr]; !ok || !info.equal(iface.info) {
+			added = append(added, addr)
+		}
+	}
+	return
+}
+
+// dsts returns the addresses the interface's OGMs and hellos are sent to: its
+// peers, its multicast group, or else its broadcast address.
+func (i ifaceInfo) dsts() []net.IP {
+	if len(i.settings.peers) > 0 {
+		dsts := make([]net.IP, len(i.settings.peers))
+		for j, peer := range i.settings.peers {
+			dsts[j] = net.ParseIP(string(peer))
+		}
+		return dsts
+	}
+	if i.settings.group != "" {
+		return []net.IP{net.ParseIP(string(i.settings.group))}
+	}
+	return []net.IP{i.bcast}
+}
+
+func (i ifaceInfo) equal(other ifaceInfo) bool {
+	return i.name == other.name && i.index == other.index && i.bcast.Equal(other.bcast) && i.settings.equal(other.settings)
+}
+
+// rescanInterfaces brings the interfaces in use in line with the local
+// addresses currently available.
+func (b *Batman) rescanInterfaces() {
+	found := scanInterfaces(b.cfg.Interfaces)
+	added, removed := interfaceChanges(b.ifaces, found)
+	for _, addr := range removed {
+		b.removeInterface(addr)
+	}
+	for _, addr := range added {
+		if err := b.addInterface(addr, found[addr]); err != nil {
+			log.Println(err)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		b.interfacesChanged()
+	}
+}
+
+// addInterface opens a socket on a local address and starts its listener and
+// broadcaster. In single socket mode, the interface shares the wildcard
+// socket and its listener instead.
+func (b *Batman) addInterface(addr ipAddr, info ifaceInfo) error {
+	iface := &netInterface{
+		addr:    addr,
+		info:    info,
+		packets: make(chan *[]byte, batIfacePacketQueueSize),
+	}
+	var oob []byte
+	if b.sharedConn != nil {
+		iface.conn = b.sharedConn
+		oob = pktinfoOOB(info.index, addr)
+	} else {
+		conn, err := openSocket(addr)
+		if err != nil {
+			return err
+		}
+		iface.conn = conn
+	}
+	if err := b.setupMulticast(iface); err != nil {
+		iface.close(b.sharedConn)
+		return err
+	}
+	var sends []func([]byte) error
+	var batches []func([][]byte) error
+	for _, ip := range info.dsts() {
+		if b.sharedConn != nil {
+			sends = append(sends, pktinfoBroadcasterFactory(b.sharedConn, info.index, addr, ip))
+		} else {
+			sends = append(sends, broadcasterFactory(iface.conn, addr, ip))
+		}
+		if b.cfg.BatchIO {
+			batch, err := batchBroadcasterFactory(iface.conn, &net.UDPAddr{IP: ip, Port: batUDPPortInt}, oob)
+			if err != nil {
+				iface.close(b.sharedConn)
+				return err
+			}
+			batches = append(batches, batch)
+		}
+	}
+	iface.broadcast = sendToAll(sends)
+	if b.cfg.BatchIO {
+		iface.broadcastBatch = sendToAll(batches)
+	}
+	for _, conn := range []*net.UDPConn{iface.conn, iface.groupConn} {
+		if conn == nil || conn == b.sharedConn {
+			continue
+		}
+		read, err := b.readerFactory(conn, addr)
+		if err != nil {
+			iface.close(b.sharedConn)
+			return err
+		}
+		b.startNetworkListener(conn, read)
+	}
+	b.ifaces[addr] = iface
+	b.startNetworkBroadcaster(iface)
+	b.ifaceEvents <- ifaceEvent{addr, iface}
+	log.Println("interface added:", addr, "on", info.name)
+	return nil
+}
+
+// removeInterface stops using a local address. Closing the socket stops its
+// listener, and leaving the OGM bundler stops its broadcaster. Links heard on
+// the interface are purged right away, rather than left to time out.
+func (b *Batman) removeInterface(addr ipAddr) {
+	iface, ok := b.ifaces[addr]
+	if !ok {
+		return
+	}
+	delete(b.ifaces, addr)
+	b.ifaceEvents <- ifaceEvent{addr, nil}
+	iface.close(b.sharedConn)
+	b.leaveMulticast(iface)
+	log.Println("interface removed:", addr)
+
+	b.originators.dropInterface(addr, b.purgeHook)
+	b.purge(time.Now())
+}
+
+// closeInterfaces closes the sockets of all interfaces when the daemon stops.
+// The broadcasters stop on their own once the OGM bundler shuts down.
+func (b *Batman) closeInterfaces() {
+	for addr, iface := range b.ifaces {
+		iface.close(b.sharedConn)
+		delete(b.ifaces, addr)
+	}
+}
+
+// sendToAll combines the senders to each of an interface's destinations into
+// one that sends to all of them.
+func sendToAll[P any](sends []func(P) error) func(P) error {
+	if len(sends) == 1 {
+		return sends[0]
+	}
+	return func(pkt P) error {
+		var firstErr error
+		for _, send := range sends {
+			if err := send(pkt); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+// close closes the interface's sockets, except for the shared one.
+func (iface *netInterface) close(shared *net.UDPConn) {
+	if iface.conn != shared {
+		iface.conn.Close()
+	}
+	if iface.groupConn != nil {
+		iface.groupConn.Close()
+	}
+}
+
+// setupMulticast prepares a multicast interface's sockets: it sets the
+// multicast options on its socket and has the group received, on a socket of
+// its own or on the shared one.
+func (b *Batman) setupMulticast(iface *netInterface) error {
+	group, index := iface.info.settings.group, iface.info.index
+	if group == "" {
+		return nil
+	}
+	if iface.conn == b.sharedConn {
+		if err := setMulticastOptions(b.sharedConn, 0); err != nil {
+			return err
+		}
+		return joinGroup(b.sharedConn, group, index, true)
+	}
+	if err := setMulticastOptions(iface.conn, index); err != nil {
+		return err
+	}
+	conn, err := openGroupSocket(group, index)
+	if err != nil {
+		return err
+	}
+	iface.groupConn = conn
+	return nil
+}
+
+// leaveMulticast has the shared socket leave a removed interface's group,
+// unless another address on the interface still uses it. Per address group
+// sockets leave as they are closed.
+func (b *Batman) leaveMulticast(iface *netInterface) {
+	group, index := iface.info.settings.group, iface.info.index
+	if group == "" || iface.conn != b.sharedConn {
+		return
+	}
+	for _, other := range b.ifaces {
+		if other.info.index == index && other.info.settings.group == group {
+			return
+		}
+	}
+	_ = joinGroup(b.sharedConn, group, index, false) // The interface may be gone already
+}
+
+// readerFactory returns the reader for a listener on conn, either a socket of
+// the interface with address rxAddr or the shared one: a batched one with
+// batched I/O, or else one reading a datagram at a time.
+func (b *Batman) readerFactory(conn *net.UDPConn, rxAddr ipAddr) (func() ([]datagram, error), error) {
+	shared := conn == b.sharedConn
+	if b.cfg.BatchIO {
+		ingress := fixedIngress(rxAddr)
+		if shared {
+			ingress = pktinfoIngress(b.ingressAddr)
+		}
+		return batchReaderFactory(conn, b.isOwnAddr, ingress)
+	}
+	if shared {
+		return singleReads(pktinfoReaderFactory(conn, b.isOwnAddr, b.ingressAddr)), nil
+	}
+	return singleReads(packetReaderFactory(conn, rxAddr, b.isOwnAddr)), nil
+}
+
+// interfacesChanged updates what depends on the set of interfaces: the own
+// addresses the listeners ignore, the per-interface hop penalties, the
+// choice of primary interface, and the address that stands for each
+// interface index in single socket mode.
+func (b *Batman) interfacesChanged() {
+	own := make(map[ipAddr]int, len(b.ifaces))
+	penalties := make(map[ipAddr]byte, len(b.ifaces))
+	for addr, iface := range b.ifaces {
+		own[addr] = iface.info.index
+		penalties[addr] = iface.info.settings.hopPenalty
+	}
+	b.ownAddrs.Store(own)
+	b.originators.hopPenalties = penalties
+
+	b.primaryAddr = primaryAddress(b.cfg.PrimaryAddr, own)
+	byIndex := make(map[int]ipAddr, len(b.ifaces))
+	for addr, iface := range b.ifaces {
+		iface.primary.Store(addr == b.primaryAddr)
+		// Of several addresses on one interface, prefer the primary, and
+		// then the lowest, like primaryAddress does.
+		current, taken := byIndex[iface.info.index]
+		if !taken || current != b.primaryAddr && (addr == b.primaryAddr || addrLess(addr, current)) {
+			byIndex[iface.info.index] = addr
+		}
+	}
+	b.ifaceIndex.Store(byIndex)
+}
+
+// isOwnAddr reports whether addr is one of our interface addresses. It is
+// safe to call from the listeners.
+func (b *Batman) isOwnAddr(addr ipAddr) bool {
+	_, ok := b.ownIndex(addr)
+	return ok
+}
+
+// ownIndex returns the index of the interface with our address addr. It is
+// safe to call from the listeners.
+func (b *Batman) ownIndex(addr ipAddr) (int, bool) {
+	own, _ := b.ownAddrs.Load().(map[ipAddr]int)
+	index, ok := own[addr]
+	return index, ok
+}
+
+// ingressAddr maps the interface index and local address a packet arrived
+// with on the wildcard socket to the address of one of our interfaces. It is
+// safe to call from the listeners.
+func (b *Batman) ingressAddr(ifindex int, local ipAddr) (ipAddr, bool) {
+	if b.isOwnAddr(local) {
+		return local, true
+	}
+	byIndex, _ := b.ifaceIndex.Load().(map[int]ipAddr)
+	addr, ok := byIndex[ifindex]
+	return addr, ok
+}
+
+// sendTo sends a packet over conn from our address src, on the interface
+// with index ifindex, to a neighbor's address dst. On the wildcard socket,
+// IP_PKTINFO steers it out of the right interface, like the broadcasts.
+func (b *Batman) sendTo(conn *net.UDPConn, pkt []byte, ifindex int, src, dst ipAddr) error {
+	addr := &net.UDPAddr{IP: net.ParseIP(string(dst)), Port: batUDPPortInt}
+	var err error
+	if conn == b.sharedConn {
+		_, _, err = conn.WriteMsgUDP(pkt, pktinfoOOB(ifindex, src), addr)
+	} else {
+		_, err = conn.WriteToUDP(pkt, addr)
+	}
+	return err
+}
+
+// dropInterface removes every link heard on our interface iface.
+func (t *originatorTable) dropInterface(iface ipAddr, hook func(purgeEvent)) {
+	for key, id := range t.linkIndex {
+		if key.iface != iface {
+			continue
+		}
+		link := t.originators[id].links[key]
+		t.removeLink(id, key)
+		hook(purgeEvent{purgeLink, id, key, time.Since(link.heard)})
+		if !t.isNeighbor(id) {
+			hook(purgeEvent{purgeNeighbor, id, linkKey{}, 0})
+		}
+	}
+}
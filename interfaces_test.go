@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestInterfaceChanges(t *testing.T) {
+	info := func(name string, bcast net.IP) ifaceInfo {
+		return ifaceInfo{name: name, bcast: bcast, settings: defaultIfaceSettings()}
+	}
+	current := map[ipAddr]*netInterface{
+		"10.0.0.1": {addr: "10.0.0.1", info: info("wlan0", net.IPv4(10, 0, 0, 255))},
+		"10.1.0.1": {addr: "10.1.0.1", info: info("wlan1", net.IPv4(10, 1, 0, 255))},
+		"10.2.0.1": {addr: "10.2.0.1", info: info("wlan2", net.IPv4(10, 2, 0, 255))},
+		"10.4.0.1": {addr: "10.4.0.1", info: info("wlan4", net.IPv4(10, 4, 0, 255))},
+	}
+	slower := info("wlan4", net.IPv4(10, 4, 0, 255))
+	slower.settings.ogmInterval = 5 * time.Second
+	found := map[ipAddr]ifaceInfo{
+		"10.0.0.1": info("wlan0", net.IPv4(10, 0, 0, 255)),   // unchanged
+		"10.2.0.1": info("wlan2", net.IPv4(10, 2, 255, 255)), // netmask changed
+		"10.3.0.1": info("wlan3", net.IPv4(10, 3, 0, 255)),   // new
+		"10.4.0.1": slower,                                   // settings changed
+	}
+	added, removed := interfaceChanges(current, found)
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	if len(added) != 3 || added[0] != "10.2.0.1" || added[1] != "10.3.0.1" || added[2] != "10.4.0.1" {
+		t.Error("interfaceChanges: wrong interfaces added:", added)
+	}
+	if len(removed) != 3 || removed[0] != "10.1.0.1" || removed[1] != "10.2.0.1" || removed[2] != "10.4.0.1" {
+		t.Error("interfaceChanges: wrong interfaces removed:", removed)
+	}
+
+	// Changed peers start an interface over, too.
+	wg := info("wg0", nil)
+	wg.settings.peers = []ipAddr{"10.9.0.2"}
+	moved := wg
+	moved.settings.peers = []ipAddr{"10.9.0.3"}
+	added, removed = interfaceChanges(map[ipAddr]*netInterface{"10.9.0.1": {addr: "10.9.0.1", info: wg}}, map[ipAddr]ifaceInfo{"10.9.0.1": moved})
+	if len(added) != 1 || len(removed) != 1 {
+		t.Error("interfaceChanges: peer change not picked up:", added, removed)
+	}
+
+	if added, removed := interfaceChanges(nil, nil); added != nil || removed != nil {
+		t.Error("interfaceChanges: changes without interfaces:", added, removed)
+	}
+}
+
+func TestSelectInterface(t *testing.T) {
+	wlan := net.FlagUp | net.FlagBroadcast | net.FlagMulticast
+	ip := net.ParseIP("10.0.0.1")
+
+	// Without rules, everything is used with the defaults.
+	if s, ok := selectInterface(nil, "wlan0", ip, wlan); !ok || !s.equal(defaultIfaceSettings()) {
+		t.Error("selectInterface: default selection:", s, ok)
+	}
+
+	// Only excludes: anything else is still used.
+	excludes := []InterfaceRule{{Name: "docker*", Exclude: true}, {CIDR: "172.16.0.0/12", Exclude: true}}
+	if _, ok := selectInterface(excludes, "docker0", net.ParseIP("10.9.0.1"), wlan); ok {
+		t.Error("selectInterface: excluded name used")
+	}
+	if _, ok := selectInterface(excludes, "eth0", net.ParseIP("172.17.0.1"), wlan); ok {
+		t.Error("selectInterface: excluded range used")
+	}
+	if _, ok := selectInterface(excludes, "wlan0", ip, wlan); !ok {
+		t.Error("selectInterface: unmatched interface left out")
+	}
+
+	// The first matching rule decides, and includes leave out the unmatched.
+	penalty := byte(30)
+	rules := []InterfaceRule{
+		{Name: "wlan*", Flags: []string{"!multicast"}, Exclude: true},
+		{Name: "wlan*", HopPenalty: &penalty, MTU: 256, OGMInterval: duration{2 * time.Second}},
+		{Name: "wlan0", Exclude: true},
+	}
+	s, ok := selectInterface(rules, "wlan0", ip, wlan)
+	want := ifaceSettings{hopPenalty: 30, ogmInterval: 2 * time.Second, mtu: 256}
+	if !ok || !s.equal(want) {
+		t.Error("selectInterface: rule settings not applied:", s, ok)
+	}
+	if _, ok := selectInterface(rules, "wlan1", ip, net.FlagUp|net.FlagBroadcast); ok {
+		t.Error("selectInterface: flag rule not applied")
+	}
+	if _, ok := selectInterface(rules, "eth0", ip, wlan); ok {
+		t.Error("selectInterface: unmatched interface used despite include rules")
+	}
+
+	// A hop penalty of 0 can be set, and an unset one is the default.
+	penalty = 0
+	if s, _ := selectInterface(rules, "wlan0", ip, wlan); s.hopPenalty != 0 {
+		t.Error("selectInterface: zero hop penalty not applied:", s.hopPenalty)
+	}
+	if s, _ := selectInterface([]InterfaceRule{{MTU: 256}}, "wlan0", ip, wlan); s.hopPenalty != batTQHopPenalty {
+		t.Error("selectInterface: unset hop penalty not defaulted:", s.hopPenalty)
+	}
+
+	// A multicast rule sends to the group instead of the broadcast address.
+	info := ifaceInfo{name: "wlan0", bcast: net.IPv4(10, 0, 0, 255), settings: defaultIfaceSettings()}
+	if dsts := info.dsts(); len(dsts) != 1 || !dsts[0].Equal(info.bcast) {
+		t.Error("ifaceInfo: broadcast interface sends to", dsts)
+	}
+	info.settings, _ = selectInterface([]InterfaceRule{{Multicast: "239.255.75.1"}}, "wlan0", ip, wlan)
+	if dsts := info.dsts(); len(dsts) != 1 || !dsts[0].Equal(net.IPv4(239, 255, 75, 1)) {
+		t.Error("ifaceInfo: multicast interface sends to", dsts)
+	}
+
+	// With peers, the interface sends to each of them by unicast.
+	peers := []InterfaceRule{{Name: "wg0", Peers: []ipAddr{"10.9.0.2", "10.9.0.3"}}}
+	info.settings, _ = selectInterface(peers, "wg0", ip, net.FlagUp|net.FlagPointToPoint)
+	if dsts := info.dsts(); len(dsts) != 2 || !dsts[0].Equal(net.IPv4(10, 9, 0, 2)) || !dsts[1].Equal(net.IPv4(10, 9, 0, 3)) {
+		t.Error("ifaceInfo: interface with peers sends to", dsts)
+	}
+}
+
+func TestDropInterface(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SwitchHoldTime.Duration = 0
+	b := New(cfg)
+	var events []purgeEvent
+	b.purgeHook = func(e purgeEvent) { events = append(events, e) }
+	table := b.originators
+
+	// N2 is heard on both interfaces, N3 only on the one that goes away.
+	for _, l := range []struct {
+		id  nodeID
+		key linkKey
+	}{
+		{"N2", linkKey{"10.0.0.1", "10.0.0.2"}},
+		{"N2", linkKey{"10.1.0.1", "10.1.0.2"}},
+		{"N3", linkKey{"10.1.0.1", "10.1.0.3"}},
+	} {
+		link := table.link(l.id, l.key)
+		link.tq, link.heard = batTQMaxValue, time.Now()
+	}
+	table.updatePath("D", linkKey{"10.1.0.1", "10.1.0.3"}, newDefaultSQN(1), batTQMaxValue, 0, time.Now())
+	if _, ok := table.route("D"); !ok {
+		t.Fatal("dropInterface: no route before the interface went away")
+	}
+
+	table.dropInterface("10.1.0.1", b.purgeHook)
+	b.purge(time.Now())
+	if _, _, ok := table.linkTo(linkKey{"10.1.0.1", "10.1.0.2"}); ok {
+		t.Error("dropInterface: link on removed interface kept")
+	}
+	if _, _, ok := table.linkTo(linkKey{"10.0.0.1", "10.0.0.2"}); !ok {
+		t.Error("dropInterface: link on remaining interface dropped")
+	}
+	if table.isNeighbor("N3") || !table.isNeighbor("N2") {
+		t.Error("dropInterface: wrong neighbors left")
+	}
+	if _, ok := table.route("D"); ok {
+		t.Error("dropInterface: route via removed interface kept")
+	}
+
+	counts := make(map[string]int)
+	for _, e := range events {
+		counts[e.kind]++
+	}
+	if counts[purgeLink] != 2 || counts[purgeNeighbor] != 1 || counts[purgeRoute] != 1 {
+		t.Error("dropInterface: wrong purge events:", events)
+	}
+}
+
+func TestIngressAddr(t *testing.T) {
+	b := New(defaultConfig())
+	b.ifaces["10.0.0.9"] = &netInterface{addr: "10.0.0.9", info: ifaceInfo{name: "wlan0", index: 3}}
+	b.ifaces["10.0.0.1"] = &netInterface{addr: "10.0.0.1", info: ifaceInfo{name: "wlan0", index: 3}}
+	b.ifaces["10.1.0.1"] = &netInterface{addr: "10.1.0.1", info: ifaceInfo{name: "wlan1", index: 4}}
+	b.interfacesChanged()
+
+	// A packet to one of our addresses arrived on that address.
+	if addr, ok := b.ingressAddr(3, "10.0.0.9"); !ok || addr != "10.0.0.9" {
+		t.Error("ingressAddr: local address not used:", addr)
+	}
+	// A broadcast arrived on the interface, represented by its lowest address.
+	if addr, ok := b.ingressAddr(3, "10.0.0.255"); !ok || addr != "10.0.0.1" {
+		t.Error("ingressAddr: wrong address for interface index:", addr)
+	}
+	if _, ok := b.ingressAddr(7, "10.7.0.255"); ok {
+		t.Error("ingressAddr: packet on unused interface accepted")
+	}
+	if b.primaryAddr != "10.0.0.1" || !b.ifaces["10.0.0.1"].primary.Load() || b.ifaces["10.1.0.1"].primary.Load() {
+		t.Error("interfacesChanged: wrong primary interface:", b.primaryAddr)
+	}
+}
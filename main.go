@@ -1,11 +1,25 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to a JSON configuration file")
+	flag.Parse()
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	fmt.Println("Hello Batman")
-	b := New()
+	b := New(cfg)
 	b.Run()
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Multicast transport
+//
+// Some networks filter broadcast, and broadcast reaches every unrelated host
+// on the segment. An interface rule may instead name a multicast group: the
+// interface then joins the group, and its OGMs and hellos are sent to the
+// group rather than to the broadcast address. They are sent with TTL 1, so
+// they never leave the link, and without loopback, so that we do not read our
+// own packets back.
+//
+// A socket bound to a unicast address does not receive multicast, so in per
+// address mode a multicast interface has a second socket, bound to the group,
+// for receiving. In single socket mode, the wildcard socket joins the group
+// on the interface.
+
+// ipMulticastAll is IP_MULTICAST_ALL, which the syscall package lacks. Turned
+// off, a socket only receives the groups it joined itself, on the interfaces
+// it joined them on.
+const ipMulticastAll = 49
+
+// setMulticastOptions sets up a socket to send multicast with TTL 1, without
+// looping it back, and to only receive the groups it joins itself. An
+// interface index other than 0 makes it send multicast out of that interface.
+func setMulticastOptions(conn *net.UDPConn, ifindex int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("setMulticastOptions: %v", err)
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		s := int(fd)
+		if sockErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 1); sockErr != nil {
+			return
+		}
+		if sockErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 0); sockErr != nil {
+			return
+		}
+		if sockErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, ipMulticastAll, 0); sockErr != nil {
+			return
+		}
+		if ifindex != 0 {
+			sockErr = syscall.SetsockoptIPMreqn(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(ifindex)})
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("setMulticastOptions: %v", err)
+	}
+	return nil
+}
+
+// joinGroup joins or, if join is false, leaves a multicast group on the
+// interface with the given index. Joining a group twice is fine, as another
+// address on the same interface may have joined it already.
+func joinGroup(conn *net.UDPConn, group ipAddr, ifindex int, join bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("joinGroup: %v", err)
+	}
+	opt := syscall.IP_ADD_MEMBERSHIP
+	if !join {
+		opt = syscall.IP_DROP_MEMBERSHIP
+	}
+	mreq := &syscall.IPMreqn{Multiaddr: group.raw(), Ifindex: int32(ifindex)}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, opt, mreq)
+		if join && sockErr == syscall.EADDRINUSE {
+			sockErr = nil
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("joinGroup: %s on interface %d: %v", group, ifindex, err)
+	}
+	return nil
+}
+
+// openGroupSocket opens a socket that receives a multicast group on the
+// interface with the given index. Several interfaces may share a group, so
+// the port is bound with SO_REUSEADDR. The socket is made by hand, as the
+// net package binds sockets for multicast addresses to the wildcard address,
+// which the per address sockets' port is taken on.
+func openGroupSocket(group ipAddr, ifindex int) (*net.UDPConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("openGroupSocket: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "group "+string(group))
+	defer f.Close()
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, fmt.Errorf("openGroupSocket: SO_REUSEADDR: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: batUDPPortInt, Addr: group.raw()}); err != nil {
+		return nil, fmt.Errorf("openGroupSocket: bind %s: %v", group, err)
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("openGroupSocket: %v", err)
+	}
+	conn := pc.(*net.UDPConn)
+	if err := setMulticastOptions(conn, ifindex); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("openGroupSocket: %v", err)
+	}
+	if err := joinGroup(conn, group, ifindex, true); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("openGroupSocket: %v", err)
+	}
+	if err := enableRxTimestamps(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("openGroupSocket: %v", err)
+	}
+	return conn, nil
+}
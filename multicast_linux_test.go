@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// multicastInterface finds an up, multicast capable, non-loopback interface
+// with an IPv4 address.
+func multicastInterface() (net.Interface, ipAddr, bool) {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return iface, ipAddr(ipnet.IP.String()), true
+			}
+		}
+	}
+	return net.Interface{}, "", false
+}
+
+func TestMulticastGroup(t *testing.T) {
+	iface, addr, ok := multicastInterface()
+	if !ok {
+		t.Skip("multicast: no multicast capable interface")
+	}
+	const group = "239.255.75.1"
+	rx, err := openGroupSocket(group, iface.Index)
+	if err != nil {
+		t.Skip("multicast: cannot join group:", err)
+	}
+	defer rx.Close()
+	read := packetReaderFactory(rx, addr, func(ipAddr) bool { return false })
+	dst := &net.UDPAddr{IP: net.ParseIP(group), Port: batUDPPortInt}
+
+	// A sender that loops multicast back reaches the group on this host.
+	looping, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(string(addr))})
+	if err != nil {
+		t.Fatal("multicast: sender:", err)
+	}
+	defer looping.Close()
+	looping.WriteToUDP([]byte{batPacketHello}, dst)
+	d, err := read()
+	if err != nil || len(d.data) != 1 || d.rxAddr != addr {
+		t.Fatal("multicast: group not received:", d, err)
+	}
+
+	// Our own senders do not loop their packets back.
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(string(addr))})
+	if err != nil {
+		t.Fatal("multicast: sender:", err)
+	}
+	defer sender.Close()
+	if err := setMulticastOptions(sender, iface.Index); err != nil {
+		t.Fatal("setMulticastOptions:", err)
+	}
+	sender.WriteToUDP([]byte{batPacketHello}, dst)
+	rx.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := rx.ReadFromUDP(make([]byte, 16)); err == nil {
+		t.Error("multicast: own packet looped back:", n)
+	}
+
+	// Joining twice is fine, and leaving stops reception.
+	if err := joinGroup(rx, group, iface.Index, true); err != nil {
+		t.Error("joinGroup: second join:", err)
+	}
+	if err := joinGroup(rx, group, iface.Index, false); err != nil {
+		t.Error("joinGroup: leave:", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// The multicast transport sets up its sockets with Linux socket options, such
+// as IP_MULTICAST_ALL. Elsewhere, an interface with a multicast group fails to
+// come up.
+
+var errMulticast = errors.New("multicast not supported on this platform")
+
+func setMulticastOptions(conn *net.UDPConn, ifindex int) error {
+	return errMulticast
+}
+
+func joinGroup(conn *net.UDPConn, group ipAddr, ifindex int, join bool) error {
+	return errMulticast
+}
+
+func openGroupSocket(group ipAddr, ifindex int) (*net.UDPConn, error) {
+	return nil, errMulticast
+}
@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 )
 
 // A RawOGM is BATMAN's routing overhead packet
 type RawOGM struct {
 	Origin     [4]byte // nodeID of OGM creator
+	OriginAddr [4]byte // primary interface address of OGM creator (ipAddr)
 	Sender     [4]byte // nodeID of node that transmitted OGM
 	TxAddr     [4]byte // sender interface identifier (ipAddr)
 	PrevSender [4]byte // nodeID of previous sender; \x00 if none
@@ -19,12 +21,15 @@ type RawOGM struct {
 	SQN        uint32  // Sequence Number
 	TTL        byte    // Time To Live
 	Quality    byte    // TQ metric
+	Throughput uint32  // Path bottleneck throughput (kbit/s); throughput metric
+	Interval   uint16  // Originator's OGM interval (milliseconds)
 }
 
 // Unpack converts a RawOGM to an OGM.
 func (ogm *RawOGM) Unpack() OGM {
 	return OGM{
 		Origin:     nodeIDFromBytes(ogm.Origin),
+		OriginAddr: ipAddrFromBytes(ogm.OriginAddr),
 		Sender:     nodeIDFromBytes(ogm.Sender),
 		TxAddr:     ipAddrFromBytes(ogm.TxAddr),
 		PrevSender: nodeIDFromBytes(ogm.PrevSender),
@@ -32,22 +37,27 @@ func (ogm *RawOGM) Unpack() OGM {
 		SQN:        newDefaultSQN(int(ogm.SQN)),
 		TTL:        ogm.TTL,
 		Quality:    ogm.Quality,
+		Throughput: ogm.Throughput,
+		Interval:   time.Duration(ogm.Interval) * time.Millisecond,
 	}
 }
 
 func (ogm *RawOGM) String() string {
 	return "{Origin:" + string(ogm.Origin[:]) + ", " +
+		"OriginAddr:" + net.IP(ogm.OriginAddr[:]).String() + ", " +
 		"Sender:" + string(ogm.Sender[:]) + ", " +
 		"TxAddr:" + net.IP(ogm.TxAddr[:]).String() + ", " +
 		"PrevSender:" + string(ogm.PrevSender[:]) + ", " +
 		"PrevAddr:" + net.IP(ogm.PrevAddr[:]).String() + ", " +
 		"SQN:" + strconv.FormatUint(uint64(ogm.SQN), 10) + ", " +
 		"TTL:" + strconv.FormatUint(uint64(ogm.TTL), 10) + ", " +
-		"TQ:" + strconv.FormatUint(uint64(ogm.Quality), 10) + "}"
+		"TQ:" + strconv.FormatUint(uint64(ogm.Quality), 10) + ", " +
+		"Throughput:" + strconv.FormatUint(uint64(ogm.Throughput), 10) + ", " +
+		"Interval:" + strconv.FormatUint(uint64(ogm.Interval), 10) + "}"
 }
 
 func parseOGMs(ogmBundle []byte, addr ipAddr) ([]OGM, error) {
-	if len(ogmBundle) < 27 || (len(ogmBundle)-1)%batOGMSize != 0 {
+	if len(ogmBundle) < batOGMSize+1 || (len(ogmBundle)-1)%batOGMSize != 0 {
 		//panic("malformed ogmBundle")
 		return nil, fmt.Errorf("parseOGMs: malformed ogmBundle, ogmBundle=%#v", ogmBundle)
 	}
@@ -62,6 +72,9 @@ func parseOGMs(ogmBundle []byte, addr ipAddr) ([]OGM, error) {
 		ogmRaw := RawOGM{}
 		// binary.Read(b, binary.BigEndian, &ogmRaw)
 		binary.Read(b, binary.LittleEndian, &ogmRaw)
+		if ogmRaw.SQN >= batSQNAddrSize {
+			return nil, fmt.Errorf("parseOGMs: SQN %d outside address range", ogmRaw.SQN)
+		}
 		ogm := ogmRaw.Unpack()
 		ogm.RxAddr = addr
 		// ToDo(Sean): Consider adding setting of field for TxAddr??
@@ -98,16 +111,20 @@ func packOGMs(buf *[]byte, ogms []RawOGM) error {
 
 // OGM is an equivalent representation to RawOGM using internal package types.
 type OGM struct {
-	Origin     nodeID //[4]byte // nodeID of OGM creator
-	Sender     nodeID //[4]byte // nodeID of node that transmitted OGM
-	TxAddr     ipAddr //[4]byte // sender interface identifier (ipAddr)
-	PrevSender nodeID //[4]byte // nodeID of previous sender; \x00 if none
-	PrevAddr   ipAddr //[4]byte // previous sender interface identifier (ipAddr); \x00 if none
-	SQN        sqn    //uint32
-	TTL        byte   //byte
-	Quality    byte   //TQ byte
-
-	RxAddr ipAddr // Extra info on Rx interface
+	Origin     nodeID        //[4]byte // nodeID of OGM creator
+	OriginAddr ipAddr        //[4]byte // primary interface address of OGM creator (ipAddr)
+	Sender     nodeID        //[4]byte // nodeID of node that transmitted OGM
+	TxAddr     ipAddr        //[4]byte // sender interface identifier (ipAddr)
+	PrevSender nodeID        //[4]byte // nodeID of previous sender; \x00 if none
+	PrevAddr   ipAddr        //[4]byte // previous sender interface identifier (ipAddr); \x00 if none
+	SQN        sqn           //uint32
+	TTL        byte          //byte
+	Quality    byte          //TQ byte
+	Throughput uint32        //uint32 kbit/s
+	Interval   time.Duration //uint16 milliseconds
+
+	RxAddr ipAddr    // Extra info on Rx interface
+	RxTime time.Time // Extra info on arrival time
 
 	//ToDo(Sean): Rename "TxAddr" to SenderAddr
 }
@@ -116,6 +133,7 @@ type OGM struct {
 func (s OGM) Pack() RawOGM {
 	return RawOGM{
 		Origin:     s.Origin.raw(),
+		OriginAddr: s.OriginAddr.raw(),
 		Sender:     s.Sender.raw(),
 		TxAddr:     s.TxAddr.raw(),
 		PrevSender: s.PrevSender.raw(),
@@ -123,68 +141,80 @@ func (s OGM) Pack() RawOGM {
 		SQN:        s.SQN.raw(),
 		TTL:        s.TTL,
 		Quality:    s.Quality,
+		Throughput: s.Throughput,
+		Interval:   uint16(s.Interval / time.Millisecond),
 	}
 }
 
-// ToDo(Sean): Resolve apparent duplicate of feature/responsibility between startOGMBundler and ogmQueue!
-// Probably convert the goroutine-based OGMBundler to an approach based on ogmQueue, for better transparency.
-// Currently, the OGMBundler does NOT use the correct format of a bundle, having a leading OGM count byte!
-
-// Internal queue for bundling outbound OGMs
+// An ogmQueue collects the OGMs bound for one interface, to be sent together
+// in one packet. It is flushed as soon as it reaches its highwater mark, or
+// once its oldest OGM has waited until the deadline.
 type ogmQueue struct {
-	count     int // Number of OGMs in queue
-	queueSize int // Number of OGMs that can fit in the queue
-	highwater int // Number of OGMs that should trigger send
+	count     int       // Number of OGMs in queue
+	queueSize int       // Number of OGMs that can fit in the queue
+	highwater int       // Number of OGMs that should trigger send
+	deadline  time.Time // When the oldest queued OGM must be sent by
 	ogms      []RawOGM
 }
 
 func newOGMQueue(highwater int) *ogmQueue {
 	buf := make([]RawOGM, batMaxBundleSize)
-	return &ogmQueue{0, batMaxBundleSize, highwater, buf}
+	return &ogmQueue{0, batMaxBundleSize, min(highwater, batMaxBundleSize), time.Time{}, buf}
 }
 
-func (q *ogmQueue) addOGM(ogm RawOGM) (ok, highwater bool) {
+// addOGM queues an OGM, which must be sent by the deadline if it is the
+// first in the queue. It reports whether there was room for it, and whether
+// the queue is now at its highwater mark and should be flushed.
+func (q *ogmQueue) addOGM(ogm RawOGM, deadline time.Time) (ok, highwater bool) {
 	if q.count >= q.queueSize {
 		ok = false
 		highwater = true
 		return
 	}
+	if q.count == 0 {
+		q.deadline = deadline
+	}
 	q.ogms[q.count] = ogm
 	q.count++
 
-	if q.count+1 >= q.highwater {
-		highwater = true
-	}
 	ok = true
+	highwater = q.atHighwater()
 	return
 }
 
-// ToDo(Sean): Finish writing methods for ogmQueue
+// flush packs the queued OGMs into a bundle packet in buf, and empties the
+// queue. An empty queue gives no packet, and buf is returned as is.
+func (q *ogmQueue) flush(buf []byte) ([]byte, bool) {
+	if q.count < 1 {
+		return buf, false
+	}
+	if cap(buf) < 1+q.count*batOGMSize {
+		buf = make([]byte, 0, 1+q.count*batOGMSize)
+	}
+	packOGMs(&buf, q.ogms[:q.count]) // Cannot fail; there is room, and the count fits its byte
+	q.count = 0
+	return buf, true
+}
 
-// func (q *ogmQueue) flush() []byte {
-// 	if q.count < 1 {
-// 		return nil
-// 	}
-// 	b := packOGMs(q.ogms)
-// 	q.count = 0
-// 	q.ogms = q.ogms[:0]
-// 	return b
-// }
+func (q *ogmQueue) atHighwater() bool {
+	return q.count >= q.highwater
+}
 
-// func (q *ogmQueue) atHighwater() bool {
-// 	return q.count >= q.highwater
-// }
+// due reports whether the queue holds OGMs whose deadline has come.
+func (q *ogmQueue) due(now time.Time) bool {
+	return q.count > 0 && !now.Before(q.deadline)
+}
 
 // A nodeID uniquely identifies a node in the network.
 type nodeID string
 
-//  nodeIDFromBytes converts 4 raw bytes (e.g., from an OGM) into ipAddr.
+// nodeIDFromBytes converts 4 raw bytes (e.g., from an OGM) into ipAddr.
 func nodeIDFromBytes(b [4]byte) nodeID {
 	bslice := bytes.Trim(b[:], "\x00")
 	return nodeID(string(bslice))
 }
 
-//  raw converts a nodeID into 4 raw bytes (e.g., for an OGM).
+// raw converts a nodeID into 4 raw bytes (e.g., for an OGM).
 func (id *nodeID) raw() [4]byte {
 	b := []byte(*id)
 	if len(b) > 4 {
@@ -202,7 +232,7 @@ func (id *nodeID) raw() [4]byte {
 // A single node may have multiple IP addresses, corresponding to different links.
 type ipAddr string
 
-//  ipAddrFromBytes converts 4 raw bytes (e.g., from an OGM) into ipAddr.
+// ipAddrFromBytes converts 4 raw bytes (e.g., from an OGM) into ipAddr.
 func ipAddrFromBytes(b [4]byte) ipAddr {
 	return ipAddr(net.IPv4(b[0], b[1], b[2], b[3]).String())
 }
@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 var sampleOGM = RawOGM{
 	Origin:     [4]byte{0, 0, 0, 1},
+	OriginAddr: [4]byte{0, 0, 0, 6},
 	Sender:     [4]byte{0, 0, 0, 2},
 	TxAddr:     [4]byte{0, 0, 0, 3},
 	PrevSender: [4]byte{0, 0, 0, 4},
@@ -14,6 +16,7 @@ var sampleOGM = RawOGM{
 	SQN:        42,
 	TTL:        2,
 	Quality:    128,
+	Interval:   1000,
 }
 
 func TestPackUnpackSingle(t *testing.T) {
@@ -49,6 +52,7 @@ func TestPackUnpackTwo(t *testing.T) {
 func TestSimpleOGMRawConversion(t *testing.T) {
 	s := OGM{
 		Origin:     "5",
+		OriginAddr: "10.4.6.5",
 		Sender:     "7",
 		TxAddr:     "10.4.6.2",
 		PrevSender: "2",
@@ -73,4 +77,49 @@ func TestOGMRawSimpleOGMConversion(t *testing.T) {
 	}
 }
 
-// ToDo(Sean): Add tests for ogmQueue
+func TestOGMQueue(t *testing.T) {
+	start := time.Unix(1000, 0)
+	q := newOGMQueue(3)
+
+	// An empty queue is never due and gives no packet.
+	if q.due(start.Add(time.Hour)) {
+		t.Error("ogmQueue: empty queue due")
+	}
+	if _, ok := q.flush(nil); ok {
+		t.Error("ogmQueue: empty queue flushed")
+	}
+
+	// The first OGM sets the deadline; later ones keep it.
+	if ok, full := q.addOGM(sampleOGM, start.Add(time.Second)); !ok || full {
+		t.Error("ogmQueue: first OGM:", ok, full)
+	}
+	if ok, full := q.addOGM(sampleOGM, start.Add(2*time.Second)); !ok || full {
+		t.Error("ogmQueue: second OGM:", ok, full)
+	}
+	if q.due(start) || !q.due(start.Add(time.Second)) {
+		t.Error("ogmQueue: wrong deadline:", q.deadline)
+	}
+	if ok, full := q.addOGM(sampleOGM, start); !ok || !full {
+		t.Error("ogmQueue: highwater not reached:", ok, full)
+	}
+
+	pkt, ok := q.flush(make([]byte, 0, 8))
+	if !ok || len(pkt) != 1+3*batOGMSize || pkt[0] != 3 {
+		t.Error("ogmQueue: wrong packet:", len(pkt), ok)
+	}
+	if ogms, err := parseOGMs(pkt, "10.0.0.1"); err != nil || len(ogms) != 3 || ogms[0].Pack() != sampleOGM {
+		t.Error("ogmQueue: packet does not parse back:", ogms, err)
+	}
+	if q.count != 0 || q.due(start.Add(time.Hour)) {
+		t.Error("ogmQueue: not empty after flush")
+	}
+
+	// The queue never takes more than a bundle.
+	q = newOGMQueue(batMaxBundleSize + 5)
+	for i := 0; i < batMaxBundleSize; i++ {
+		q.addOGM(sampleOGM, start)
+	}
+	if ok, full := q.addOGM(sampleOGM, start); ok || !full {
+		t.Error("ogmQueue: overfilled:", ok, full)
+	}
+}
@@ -11,15 +11,67 @@ const (
 	batCutoffEQSamples = 10
 	batCutoffTQ        = 10
 
+	batTQGlobalWindowSize = 5 // Number of recent OGMs over which the TQ reported via a next hop is averaged
+
+	batDupWindowSize = 64 // Number of recent SQNs of each originator whose OGM copies are tracked
+
 	batTQMaxValue   = 255
 	batTQHopPenalty = 10
 
+	batSwitchMargin        = 0 // Absolute metric margin a new next hop must beat the current one by
+	batSwitchMarginPercent = 5 // Same, relative to the current next hop's metric (%)
+	batSwitchHoldTime      = 5 // Minimum seconds to keep a next hop before switching
+
+	batThroughputMax   = 0xFFFFFFFF // (kbit/s) Throughput advertised in own OGMs; no bottleneck yet
+	batDefaultLinkRate = 1000       // (kbit/s) Assumed link throughput when neither configured nor probed
+	batProbeInterval   = 10         // Seconds between throughput probes to each neighbor link
+	batProbeSize       = 512        // Bytes in each probe packet of a probe pair
+
+	batHelloInterval     = 500 // (Milliseconds) Time between ELP hellos on each interface
+	batHelloJitter       = 50  // (Milliseconds) Max additive variation for randomized hello interval
+	batMaxHelloNeighbors = 62  // Max neighbor entries in a hello; 12 + 8 * batMaxHelloNeighbors <= batSafePacketSize
+
 	batTTL            = 16 // OGM packet Time To Live (number of forwarding hops)
-	batOGMSize        = 26
+	batFishEyeHops    = 3  // Hops from their origin beyond which OGMs are thinned in fish-eye mode
+	batSecondaryTTL   = 1  // TTL of own OGMs sent on secondary interfaces; they only reach neighbors
+	batOGMSize        = 36
 	batSafePacketSize = 512 // ToDo(Sean): Make this a per-link (or link type) thing
-	batMaxBundleSize  = 19  // Max OGMs bundled together;  batOGMSize * batMaxBundleSize < batSafePacketSize
+	batMaxBundleSize  = 14  // Max OGMs bundled together;  batOGMSize * batMaxBundleSize < batSafePacketSize
 	batMaxBundleDelay = 200 // Milliseconds to delay transmission waiting for more OGMs
 
-	batOGMInterval = 1   // Seconds between sending own OGM
-	batOGMJitter   = 100 // (Milliseconds) Max additive variation for randomized OGM interval
+	batPacketBufferSize = 4096 // Bytes in each buffer packets are read into
+	batIOBatchSize      = 32   // Max datagrams read or sent per system call with batched I/O
+
+	batOutboundQueueSize    = 256 // Max OGMs waiting for the bundler
+	batInboundQueueSize     = 256 // Max received OGMs waiting for the OGM handler loop
+	batHelloQueueSize       = 64  // Max received hellos waiting for the OGM handler loop
+	batProbeReportQueueSize = 64  // Max received probe reports waiting for the OGM handler loop
+	batIfacePacketQueueSize = 16  // Max bundle packets waiting for each interface's broadcaster
+
+	batSenderRate      = 200 // OGMs, or other packets, per second accepted from each sender on average
+	batSenderBurst     = 400 // Max OGMs, or other packets, accepted from each sender at once
+	batMalformedLimit  = 10  // Malformed packets within batMalformedWindow that get a sender quarantined
+	batMalformedWindow = 10  // Seconds over which a sender's malformed packets are counted
+	batQuarantineTime  = 60  // Seconds a quarantined sender's packets are dropped
+
+	batOGMInterval    = 1   // Seconds between sending own OGM; the shortest interval in adaptive mode
+	batMaxOGMInterval = 32  // Longest seconds between own OGMs in adaptive mode
+	batOGMJitter      = 100 // (Milliseconds) Max additive variation for randomized OGM interval
+
+	batLinkTimeout       = 10 // Seconds without a hello before a neighbor link is purged
+	batHopTimeout        = 30 // Seconds without an OGM via a next hop before it is purged
+	batOriginatorTimeout = 60 // Seconds without any OGM from an originator before it is purged
+	batPurgeInterval     = 1  // Seconds between sweeps for timed out entries
+
+	batInterfaceScanInterval = 5     // Seconds between rescans for added and removed interfaces
+	batMinMTU                = 128   // Smallest configurable interface MTU; fits an OGM bundle and a hello
+	batMaxMTU                = 65507 // Largest UDP payload over IPv4
+)
+
+// Packet types. An OGM bundle begins with its OGM count, which never exceeds
+// batMaxBundleSize, so leading byte values above that mark other packet types.
+const (
+	batPacketProbe       = 0xF0 // Unicast throughput probe, sent in pairs
+	batPacketProbeReport = 0xF1 // Throughput measured from a probe pair, returned to the prober
+	batPacketHello       = 0xF2 // ELP hello for neighbor discovery and link sensing; never forwarded
 )
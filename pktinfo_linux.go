@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Single socket mode
+//
+// Instead of one socket per local address, a single socket bound to the
+// wildcard address serves all interfaces. IP_PKTINFO control messages tell
+// which interface each packet came in on, and steer each broadcast out of the
+// right interface with the right source address.
+
+// openWildcardSocket opens a UDP socket on the wildcard address with
+// IP_PKTINFO control messages turned on.
+func openWildcardSocket(port int) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("openWildcardSocket: %v", err)
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("openWildcardSocket: %v", err)
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("openWildcardSocket: IP_PKTINFO: %v", err)
+	}
+	if err := enableRxTimestamps(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("openWildcardSocket: %v", err)
+	}
+	return conn, nil
+}
+
+// parsePktinfo finds the IP_PKTINFO control message among those received
+// with a packet.
+func parsePktinfo(oob []byte) (syscall.Inet4Pktinfo, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return syscall.Inet4Pktinfo{}, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo {
+			return *(*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0])), true
+		}
+	}
+	return syscall.Inet4Pktinfo{}, false
+}
+
+// pktinfoOOB builds the IP_PKTINFO control message that sends a packet out of
+// interface ifindex with source address src.
+func pktinfoOOB(ifindex int, src ipAddr) []byte {
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IP
+	h.Type = syscall.IP_PKTINFO
+	h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+	info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+	info.Ifindex = int32(ifindex)
+	info.Spec_dst = src.raw()
+	return oob
+}
+
+// Call pktinfoReaderFactory to get a function that will (blocking, 30s) read
+// a datagram from a wildcard socket, just like packetReaderFactory does for a
+// per-address socket. The ingress function maps the interface index and local
+// address from the packet's IP_PKTINFO to the address of one of our
+// interfaces; packets that arrive on no interface in use are dropped.
+func pktinfoReaderFactory(conn *net.UDPConn, ignore func(ipAddr) bool, ingress func(ifindex int, local ipAddr) (ipAddr, bool)) func() (datagram, error) {
+	data := make([]byte, batPacketBufferSize)
+	oob := make([]byte, rxOOBSize)
+	rxAddress := pktinfoIngress(ingress)
+
+	return func() (datagram, error) {
+		// Note: It is CRITCAL that conn MUST have a read deadline set.
+		conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		n, oobn, _, addr, err := conn.ReadMsgUDP(data, oob)
+		if err != nil {
+			return datagram{}, err
+		}
+		// Ignore own transmissions
+		if ignore(ipAddr(addr.IP.String())) {
+			return datagram{}, nil
+		}
+		rxAddr, ok := rxAddress(oob[:oobn])
+		if !ok {
+			return datagram{}, nil
+		}
+		return datagram{data[:n], ipAddr(addr.IP.String()), rxAddr, rxTimestamp(oob[:oobn], time.Now())}, nil
+	}
+}
+
+// pktinfoIngress returns a function that tells from a packet's control
+// messages which of our interface addresses it arrived on, for the wildcard
+// socket.
+func pktinfoIngress(ingress func(ifindex int, local ipAddr) (ipAddr, bool)) func(oob []byte) (ipAddr, bool) {
+	return func(oob []byte) (ipAddr, bool) {
+		info, ok := parsePktinfo(oob)
+		if !ok {
+			return "", false
+		}
+		return ingress(int(info.Ifindex), ipAddrFromBytes(info.Spec_dst))
+	}
+}
+
+// pktinfoBroadcasterFactory returns a function that will send a byte slice as
+// a UDP broadcast packet out of interface ifindex, from source address src,
+// over a wildcard socket.
+func pktinfoBroadcasterFactory(conn *net.UDPConn, ifindex int, src ipAddr, bcast net.IP) func([]byte) error {
+	broadcastAddr := &net.UDPAddr{IP: bcast, Port: batUDPPortInt}
+	oob := pktinfoOOB(ifindex, src)
+
+	return func(pkt []byte) error {
+		n, _, err := conn.WriteMsgUDP(pkt, oob, broadcastAddr)
+		if err != nil {
+			return err
+		} else if n != len(pkt) {
+			return fmt.Errorf("broadcaster: WriteMsgUDP: wrong number of bytes sent: len(pkt)=%v, n=%v", len(pkt), n)
+		}
+		return nil
+	}
+}
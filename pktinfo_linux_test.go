@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPktinfoRoundTrip(t *testing.T) {
+	conn, err := openWildcardSocket(0)
+	if err != nil {
+		t.Skip("pktinfo: no wildcard socket:", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("pktinfo: no loopback interface:", err)
+	}
+
+	// Send from a second wildcard socket, steered by our own IP_PKTINFO.
+	sender, err := openWildcardSocket(0)
+	if err != nil {
+		t.Fatal("pktinfo: second socket:", err)
+	}
+	defer sender.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	if _, _, err := sender.WriteMsgUDP([]byte{batPacketHello}, pktinfoOOB(lo.Index, "127.0.0.1"), dst); err != nil {
+		t.Fatal("pktinfo: send:", err)
+	}
+
+	var gotIndex int
+	var gotLocal ipAddr
+	ingress := func(ifindex int, local ipAddr) (ipAddr, bool) {
+		gotIndex, gotLocal = ifindex, local
+		return "10.0.0.1", true
+	}
+	read := pktinfoReaderFactory(conn, func(ipAddr) bool { return false }, ingress)
+	d, err := read()
+	if err != nil {
+		t.Fatal("pktinfo: read:", err)
+	}
+	if gotIndex != lo.Index || gotLocal != "127.0.0.1" {
+		t.Error("pktinfo: wrong ingress:", gotIndex, gotLocal)
+	}
+	if d.srcAddr != "127.0.0.1" || d.rxAddr != "10.0.0.1" || len(d.data) != 1 {
+		t.Error("pktinfo: wrong datagram:", d)
+	}
+
+	// Packets from our own addresses, and those on no interface in use,
+	// are dropped.
+	sender.WriteToUDP([]byte{batPacketHello}, dst)
+	read = pktinfoReaderFactory(conn, func(addr ipAddr) bool { return addr == "127.0.0.1" }, ingress)
+	if d, err := read(); err != nil || d.data != nil {
+		t.Error("pktinfo: own packet not ignored:", d, err)
+	}
+	sender.WriteToUDP([]byte{batPacketHello}, dst)
+	read = pktinfoReaderFactory(conn, func(ipAddr) bool { return false }, func(int, ipAddr) (ipAddr, bool) { return "", false })
+	if d, err := read(); err != nil || d.data != nil {
+		t.Error("pktinfo: packet on unused interface not dropped:", d, err)
+	}
+}
+
+func TestSendToPktinfo(t *testing.T) {
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: batUDPPortInt})
+	if err != nil {
+		t.Skip("sendTo: batman port taken:", err)
+	}
+	defer rx.Close()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("sendTo: no loopback interface:", err)
+	}
+	b := New(defaultConfig())
+	if b.sharedConn, err = openWildcardSocket(0); err != nil {
+		t.Skip("sendTo: no wildcard socket:", err)
+	}
+	defer b.sharedConn.Close()
+
+	// Unicasts on the wildcard socket go out with IP_PKTINFO, on per address
+	// sockets without.
+	if err := b.sendTo(b.sharedConn, []byte{batPacketProbe}, lo.Index, "127.0.0.1", "127.0.0.1"); err != nil {
+		t.Fatal("sendTo: wildcard socket:", err)
+	}
+	if err := b.sendTo(rx, []byte{batPacketProbe}, lo.Index, "127.0.0.1", "127.0.0.1"); err != nil {
+		t.Fatal("sendTo: per address socket:", err)
+	}
+	buf := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		rx.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _, err := rx.ReadFromUDP(buf); err != nil || n != 1 || buf[0] != batPacketProbe {
+			t.Fatal("sendTo: packet not received:", i, n, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Single socket mode needs IP_PKTINFO, both to tell which interface a packet
+// came in on and to steer broadcasts out of the right one. Elsewhere than on
+// Linux, the wildcard socket cannot be opened, and the rest is never reached.
+
+var errSingleSocket = errors.New("single socket mode not supported on this platform")
+
+func openWildcardSocket(port int) (*net.UDPConn, error) {
+	return nil, errSingleSocket
+}
+
+func pktinfoOOB(ifindex int, src ipAddr) []byte {
+	return nil
+}
+
+func pktinfoReaderFactory(conn *net.UDPConn, ignore func(ipAddr) bool, ingress func(ifindex int, local ipAddr) (ipAddr, bool)) func() (datagram, error) {
+	return func() (datagram, error) {
+		return datagram{}, errSingleSocket
+	}
+}
+
+func pktinfoIngress(ingress func(ifindex int, local ipAddr) (ipAddr, bool)) func(oob []byte) (ipAddr, bool) {
+	return func([]byte) (ipAddr, bool) {
+		return "", false
+	}
+}
+
+func pktinfoBroadcasterFactory(conn *net.UDPConn, ifindex int, src ipAddr, bcast net.IP) func([]byte) error {
+	return func([]byte) error {
+		return errSingleSocket
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Throughput probing
+//
+// Without help from the radio driver, link throughput is estimated with the
+// packet-pair technique: a pair of large unicast probes is sent back to back,
+// and the link spreads them apart by the time it needs to carry the second
+// one. The receiver turns the gap between their arrivals into a throughput
+// estimate and returns it in a probe report, since it is the prober that
+// routes over the link in that direction.
+
+// A RawProbe is one packet of a probe pair. On the wire it is padded with
+// zeros up to batProbeSize bytes, or to the interface MTU if that is smaller.
+type RawProbe struct {
+	Type   byte    // batPacketProbe
+	Sender [4]byte // nodeID of the prober
+	Seq    uint16  // Probe pair sequence number
+	Index  byte    // Position within the pair; 0 or 1
+}
+
+// A RawProbeReport returns the throughput measured from a probe pair.
+type RawProbeReport struct {
+	Type       byte    // batPacketProbeReport
+	Sender     [4]byte // nodeID of the node that measured the probe pair
+	Seq        uint16  // Sequence number of the measured probe pair
+	Throughput uint32  // Measured throughput (kbit/s)
+}
+
+// probeReport carries a received RawProbeReport to the OGM handler.
+type probeReport struct {
+	from       linkKey // Link the report came back on
+	throughput uint32
+}
+
+func packProbe(buf *[]byte, probe RawProbe, size int) error {
+	if size < binary.Size(probe) || size > batProbeSize {
+		return fmt.Errorf("packProbe: invalid probe size %d", size)
+	}
+	if cap(*buf) < size {
+		return fmt.Errorf("packProbe: byte slice too small for probe size %d", size)
+	}
+	buffer := bytes.NewBuffer((*buf)[:0])
+	if err := binary.Write(buffer, binary.LittleEndian, probe); err != nil {
+		return fmt.Errorf("packProbe: %v", err)
+	}
+	*buf = buffer.Bytes()
+	for len(*buf) < size {
+		*buf = append(*buf, 0)
+	}
+	return nil
+}
+
+func parseProbe(pkt []byte) (RawProbe, error) {
+	probe := RawProbe{}
+	if len(pkt) < binary.Size(probe) || len(pkt) > batProbeSize {
+		return probe, fmt.Errorf("parseProbe: malformed probe of %d bytes", len(pkt))
+	}
+	binary.Read(bytes.NewReader(pkt), binary.LittleEndian, &probe)
+	if probe.Index > 1 {
+		return probe, fmt.Errorf("parseProbe: invalid probe index %d", probe.Index)
+	}
+	return probe, nil
+}
+
+func packProbeReport(buf *[]byte, report RawProbeReport) error {
+	buffer := bytes.NewBuffer((*buf)[:0])
+	if err := binary.Write(buffer, binary.LittleEndian, report); err != nil {
+		return fmt.Errorf("packProbeReport: %v", err)
+	}
+	*buf = buffer.Bytes()
+	return nil
+}
+
+func parseProbeReport(pkt []byte) (RawProbeReport, error) {
+	report := RawProbeReport{}
+	if len(pkt) != binary.Size(report) {
+		return report, fmt.Errorf("parseProbeReport: malformed report of %d bytes", len(pkt))
+	}
+	binary.Read(bytes.NewReader(pkt), binary.LittleEndian, &report)
+	return report, nil
+}
+
+// probeThroughput converts the arrival gap of a probe pair into kbit/s.
+// It returns false if the gap cannot be measured.
+func probeThroughput(size int, gap time.Duration) (uint32, bool) {
+	if gap <= 0 {
+		return 0, false
+	}
+	kbps := uint64(size) * 8 * uint64(time.Second/time.Microsecond) / uint64(gap.Nanoseconds())
+	if kbps > batThroughputMax {
+		kbps = batThroughputMax
+	}
+	return uint32(kbps), true
+}
+
+// A probeTimer pairs up received probes per sender. Each network listener
+// keeps its own, so it needs no locking.
+type probeTimer struct {
+	pending map[ipAddr]probeArrival
+}
+
+type probeArrival struct {
+	seq  uint16
+	size int
+	when time.Time
+}
+
+func newProbeTimer() *probeTimer {
+	return &probeTimer{pending: make(map[ipAddr]probeArrival)}
+}
+
+// receive registers a probe of size bytes from the given sender, returning the
+// measured throughput once the second probe of a pair arrives.
+func (pt *probeTimer) receive(from ipAddr, probe RawProbe, size int, when time.Time) (uint32, bool) {
+	if probe.Index == 0 {
+		// Forget pairs that never completed, so that departed senders do not
+		// pile up.
+		for addr, first := range pt.pending {
+			if when.Sub(first.when) > time.Second {
+				delete(pt.pending, addr)
+			}
+		}
+		pt.pending[from] = probeArrival{probe.Seq, size, when}
+		return 0, false
+	}
+	first, ok := pt.pending[from]
+	if !ok || first.seq != probe.Seq || first.size != size {
+		return 0, false
+	}
+	delete(pt.pending, from)
+	return probeThroughput(size, when.Sub(first.when))
+}
+
+// sendProbes sends a probe pair to each neighbor link whose rate is not
+// configured. Probes are cut down to the MTU of interfaces that cannot carry
+// batProbeSize bytes.
+func (b *Batman) sendProbes() {
+	b.probeSeq++
+	msg := make([]byte, 0, batProbeSize)
+	b.originators.forEachLink(func(id nodeID, key linkKey, link *linkData) {
+		if _, ok := b.cfg.LinkRates[key.addr]; ok {
+			return
+		}
+		if _, ok := b.cfg.LinkRates[key.iface]; ok {
+			return
+		}
+		iface, ok := b.ifaces[key.iface]
+		if !ok {
+			return
+		}
+		size := min(iface.info.settings.mtu, batProbeSize)
+		for i := byte(0); i < 2; i++ {
+			packProbe(&msg, RawProbe{batPacketProbe, b.id.raw(), b.probeSeq, i}, size)
+			if err := b.sendTo(iface.conn, msg, iface.info.index, key.iface, key.addr); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// processProbeReport folds a returned throughput measurement into the
+// estimate for the link it was measured on, which linkFrom finds also when
+// the neighbor answers from another of its addresses. Single measurements
+// are noisy, so a moving average is kept.
+func (b *Batman) processProbeReport(report probeReport) {
+	_, link, ok := b.originators.linkFrom(report.from)
+	if !ok {
+		return
+	}
+	if link.throughput == 0 {
+		link.throughput = report.throughput
+	} else {
+		link.throughput = uint32((3*uint64(link.throughput) + uint64(report.throughput)) / 4)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPackParseProbe(t *testing.T) {
+	probe := RawProbe{batPacketProbe, [4]byte{0, 0, 'L', '1'}, 7, 1}
+	b := make([]byte, 0, batProbeSize)
+	if err := packProbe(&b, probe, batProbeSize); err != nil {
+		t.Error("probe error: packing:", err)
+	}
+	if len(b) != batProbeSize {
+		t.Error("probe error: probe not padded to batProbeSize:", len(b))
+	}
+	p, err := parseProbe(b)
+	if err != nil || p != probe {
+		t.Error("probe error: packing and parsing inconsistency:", probe, p, err)
+	}
+
+	// Probes are cut down to small interface MTUs, and grow no larger than
+	// batProbeSize.
+	if err := packProbe(&b, probe, batMinMTU); err != nil || len(b) != batMinMTU {
+		t.Error("probe error: probe not padded to the MTU:", len(b), err)
+	}
+	if p, err := parseProbe(b); err != nil || p != probe {
+		t.Error("probe error: rejected a probe cut down to the MTU:", p, err)
+	}
+	if err := packProbe(&b, probe, batProbeSize+1); err == nil {
+		t.Error("probe error: packed a probe larger than batProbeSize")
+	}
+	if _, err := parseProbe(make([]byte, batProbeSize+1)); err == nil {
+		t.Error("probe error: parsed a probe larger than batProbeSize")
+	}
+	if _, err := parseProbe(b[:4]); err == nil {
+		t.Error("probe error: parsed a truncated probe")
+	}
+
+	report := RawProbeReport{batPacketProbeReport, [4]byte{0, 0, 'L', '2'}, 7, 54000}
+	if err := packProbeReport(&b, report); err != nil {
+		t.Error("probe error: packing report:", err)
+	}
+	r, err := parseProbeReport(b)
+	if err != nil || r != report {
+		t.Error("probe error: report packing and parsing inconsistency:", report, r, err)
+	}
+}
+
+func TestProbeTimer(t *testing.T) {
+	pt := newProbeTimer()
+	start := time.Now()
+
+	if _, ok := pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 1, 0}, batProbeSize, start); ok {
+		t.Error("probeTimer: measured throughput from a single probe")
+	}
+	if _, ok := pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 2, 1}, batProbeSize, start); ok {
+		t.Error("probeTimer: paired probes of different sequence numbers")
+	}
+
+	// 512 bytes arriving 1ms apart is 4096 kbit/s
+	pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 3, 0}, batProbeSize, start)
+	kbps, ok := pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 3, 1}, batProbeSize, start.Add(time.Millisecond))
+	if !ok || kbps != 4096 {
+		t.Error("probeTimer: wrong throughput:", kbps, ok)
+	}
+
+	// 128 byte probes of a small MTU interface are 1024 kbit/s
+	pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 4, 0}, batMinMTU, start)
+	kbps, ok = pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 4, 1}, batMinMTU, start.Add(time.Millisecond))
+	if !ok || kbps != 1024 {
+		t.Error("probeTimer: wrong throughput for small probes:", kbps, ok)
+	}
+	pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 5, 0}, batMinMTU, start)
+	if _, ok := pt.receive("10.0.0.2", RawProbe{batPacketProbe, [4]byte{}, 5, 1}, batProbeSize, start.Add(time.Millisecond)); ok {
+		t.Error("probeTimer: paired probes of different sizes")
+	}
+
+	if _, ok := probeThroughput(batProbeSize, 0); ok {
+		t.Error("probeThroughput: accepted a zero gap")
+	}
+}
+
+func TestProcessProbeReport(t *testing.T) {
+	b := New(defaultConfig())
+	link := b.originators.link("N2", testLink("10.0.0.2"))
+	b.originators.announce("N2", "10.9.0.2")
+
+	// A report from the link's address, and one from another of N2's
+	// addresses, both go to the link; one from an unknown address does not.
+	b.processProbeReport(probeReport{testLink("10.0.0.2"), 4000})
+	b.processProbeReport(probeReport{testLink("10.9.0.2"), 8000})
+	b.processProbeReport(probeReport{testLink("10.0.0.9"), 8000})
+	if link.throughput != 5000 {
+		t.Error("processProbeReport: wrong throughput:", link.throughput)
+	}
+
+	// Once N2 has two links on the interface, a report from its other
+	// address is ambiguous, and dropped.
+	b.originators.link("N2", testLink("10.0.0.3"))
+	b.processProbeReport(probeReport{testLink("10.9.0.2"), 8000})
+	if link.throughput != 5000 {
+		t.Error("processProbeReport: ambiguous report credited:", link.throughput)
+	}
+}
+
+func TestSendProbesMTU(t *testing.T) {
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: batUDPPortInt})
+	if err != nil {
+		t.Skip("cannot listen on the batman port:", err)
+	}
+	defer rx.Close()
+	tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+
+	b := New(defaultConfig())
+	settings := defaultIfaceSettings()
+	settings.mtu = batMinMTU
+	b.ifaces["127.0.0.1"] = &netInterface{addr: "127.0.0.1", conn: tx, info: ifaceInfo{name: "lo", settings: settings}}
+	b.originators.link("N2", linkKey{"127.0.0.1", "127.0.0.2"})
+	b.sendProbes()
+
+	buf := make([]byte, batMaxMTU)
+	for i := 0; i < 2; i++ {
+		rx.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := rx.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal("sendProbes: probe not received:", err)
+		}
+		if n != batMinMTU {
+			t.Error("sendProbes: probe not cut down to the interface MTU:", n)
+		}
+		if _, err := parseProbe(buf[:n]); err != nil {
+			t.Error("sendProbes:", err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Purge event kinds
+const (
+	purgeLink       = "link"       // A neighbor link timed out
+	purgeNeighbor   = "neighbor"   // A neighbor's last link was purged
+	purgeHop        = "hop"        // A next hop towards an originator timed out or lost its link
+	purgeOriginator = "originator" // An originator timed out or lost its last next hop
+	purgeRoute      = "route"      // The route to an originator was withdrawn
+)
+
+// A purgeEvent reports an entry removed from the routing state.
+type purgeEvent struct {
+	kind string
+	node nodeID        // Neighbor or originator the entry belonged to
+	link linkKey       // Link or next hop link; zero for whole nodes
+	age  time.Duration // Time since the entry was last refreshed
+}
+
+func (e purgeEvent) String() string {
+	if e.link == (linkKey{}) {
+		return fmt.Sprintf("<purge %s: %s, Age=%v>", e.kind, e.node, e.age)
+	}
+	return fmt.Sprintf("<purge %s: %s via %s, Age=%v>", e.kind, e.node, e.link, e.age)
+}
+
+// logPurgeEvent is the default purge hook.
+func logPurgeEvent(e purgeEvent) {
+	log.Println(e)
+}
+
+// purge sweeps the originator table for entries that have not been refreshed
+// within their configured timeouts, and reports each removal to the purge hook.
+func (b *Batman) purge(now time.Time) {
+	b.originators.purge(now, b.purgeHook)
+}
+
+// purge removes timed out links, next hops and originators, and withdraws the
+// routes that depended on them. The timeouts of next hops and originators are
+// meant for nodes that send OGMs every OGMInterval, and are scaled to each
+// originator's advertised interval.
+func (t *originatorTable) purge(now time.Time, hook func(purgeEvent)) {
+	// Links first, so that next hops over purged links go with them. Only
+	// hellos heard on a link keep it; echoes of ours do not.
+	for id, o := range t.originators {
+		hadLinks := len(o.links) > 0
+		for key, link := range o.links {
+			if age := now.Sub(link.heard); age > t.cfg.LinkTimeout.Duration {
+				t.removeLink(id, key)
+				hook(purgeEvent{purgeLink, id, key, age})
+			}
+		}
+		if hadLinks && len(o.links) == 0 {
+			hook(purgeEvent{purgeNeighbor, id, linkKey{}, 0})
+		}
+	}
+
+	for id, o := range t.originators {
+		// Next hops
+		hadHops := len(o.nextHops) > 0
+		hopTimeout := o.scaled(t.cfg.HopTimeout.Duration, t.cfg.OGMInterval.Duration)
+		var newest time.Time
+		for key, h := range o.nextHops {
+			_, _, linked := t.linkTo(key)
+			if age := now.Sub(h.lastSeen); age > hopTimeout || !linked {
+				delete(o.nextHops, key)
+				hook(purgeEvent{purgeHop, id, key, age})
+			} else if h.lastSeen.After(newest) {
+				newest = h.lastSeen
+			}
+		}
+
+		// Originator route state
+		originatorTimeout := o.scaled(t.cfg.OriginatorTimeout.Duration, t.cfg.OGMInterval.Duration)
+		if age := now.Sub(newest); hadHops && (len(o.nextHops) == 0 || age > originatorTimeout) {
+			if newest.IsZero() {
+				age = 0
+			}
+			o.nextHops = make(map[linkKey]*hop)
+			hook(purgeEvent{purgeOriginator, id, linkKey{}, age})
+		}
+		if len(o.links) == 0 && len(o.nextHops) == 0 {
+			t.forget(id)
+		}
+
+		o.decayHops(now)
+		_, routed := t.routes[id]
+		t.selectRoute(id, now)
+		if _, stillRouted := t.routes[id]; routed && !stillRouted {
+			hook(purgeEvent{purgeRoute, id, linkKey{}, 0})
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	b := New(defaultConfig())
+	var events []purgeEvent
+	b.purgeHook = func(e purgeEvent) { events = append(events, e) }
+
+	start := time.Now()
+	n2 := newTestNeighbor(&b, "N2", "10.0.0.2", batLocalWindowSize)
+	n3 := newTestNeighbor(&b, "N3", "10.0.0.3", batLocalWindowSize)
+	n2.heard = start
+	n3.heard = start
+	n2.tq = batTQMaxValue
+
+	b.originators.updatePath("D", testLink("10.0.0.2"), newDefaultSQN(1), batTQMaxValue, 0, start)
+	b.originators.updatePath("D", testLink("10.0.0.3"), newDefaultSQN(1), batTQMaxValue, 0, start)
+
+	// Nothing has timed out yet.
+	b.purge(start.Add(time.Second))
+	if len(events) != 0 {
+		t.Error("purge: entries purged too early:", events)
+	}
+
+	// Only N3 stops sending hellos, which takes the next hop through it with it.
+	n2.heard = start.Add(b.cfg.LinkTimeout.Duration)
+	b.purge(start.Add(b.cfg.LinkTimeout.Duration + time.Second))
+	if b.originators.isNeighbor("N3") {
+		t.Error("purge: silent neighbor not purged")
+	}
+	if _, ok := b.originators.originators["N3"]; ok {
+		t.Error("purge: empty originator entry kept")
+	}
+	if _, ok := b.originators.get("D").nextHops[testLink("10.0.0.3")]; ok {
+		t.Error("purge: next hop over purged link not purged")
+	}
+	if _, ok := b.originators.route("D"); !ok {
+		t.Error("purge: route withdrawn despite remaining next hop")
+	}
+
+	// The originator stops sending OGMs.
+	events = events[:0]
+	n2.heard = start.Add(b.cfg.HopTimeout.Duration)
+	b.purge(start.Add(b.cfg.HopTimeout.Duration + time.Second))
+	if _, ok := b.originators.originators["D"]; ok {
+		t.Error("purge: originator without next hops not purged")
+	}
+	if _, ok := b.originators.route("D"); ok {
+		t.Error("purge: route to purged originator not withdrawn")
+	}
+	kinds := make(map[string]int)
+	for _, e := range events {
+		kinds[e.kind]++
+	}
+	if kinds[purgeHop] != 1 || kinds[purgeOriginator] != 1 || kinds[purgeRoute] != 1 {
+		t.Error("purge: wrong purge events:", events)
+	}
+}
+
+func TestPurgeEchoedLink(t *testing.T) {
+	b := New(defaultConfig())
+	b.purgeHook = func(purgeEvent) {}
+	start := time.Now()
+	hear := func(rx ipAddr, num int, when time.Time) {
+		b.processHello(hello{
+			sender:    "N2",
+			sqn:       newDefaultSQN(num),
+			neighbors: map[ipAddr]sqn{"10.0.0.1": newDefaultSQN(num), "10.1.0.1": newDefaultSQN(num)},
+			srcAddr:   "10.0.0.2",
+			rxAddr:    rx,
+			rxTime:    when,
+		})
+	}
+
+	// N2 hears us on both of our interfaces, but we stop hearing it on the
+	// second. Its hellos on the first keep echoing the second.
+	hear("10.0.0.1", 0, start)
+	hear("10.1.0.1", 0, start)
+	for i := 1; time.Duration(i)*time.Second <= b.cfg.LinkTimeout.Duration+time.Second; i++ {
+		hear("10.0.0.1", i, start.Add(time.Duration(i)*time.Second))
+	}
+	b.purge(start.Add(b.cfg.LinkTimeout.Duration + time.Second))
+	if _, _, ok := b.originators.linkTo(linkKey{"10.1.0.1", "10.0.0.2"}); ok {
+		t.Error("purge: link kept alive by echoes alone")
+	}
+	if _, _, ok := b.originators.linkTo(linkKey{"10.0.0.1", "10.0.0.2"}); !ok {
+		t.Error("purge: heard link purged")
+	}
+}
+
+func TestPurgeScaledTimeouts(t *testing.T) {
+	b := New(defaultConfig())
+	var events []purgeEvent
+	b.purgeHook = func(e purgeEvent) { events = append(events, e) }
+
+	start := time.Now()
+	n2 := newTestNeighbor(&b, "N2", "10.0.0.2", batLocalWindowSize)
+	n2.tq = batTQMaxValue
+	b.originators.updatePath("D", testLink("10.0.0.2"), newDefaultSQN(1), batTQMaxValue, 0, start)
+	b.originators.advertised("D", newDefaultSQN(1), 4*b.cfg.OGMInterval.Duration)
+
+	// D sends OGMs four times slower than we expect by default, so its
+	// next hop lasts four times as long. Its route goes before, once the TQ
+	// window has passed without OGMs.
+	n2.heard = start.Add(4 * b.cfg.HopTimeout.Duration)
+	b.purge(start.Add(2 * b.cfg.HopTimeout.Duration))
+	for _, e := range events {
+		if e.kind == purgeHop || e.kind == purgeOriginator {
+			t.Error("purge: slow originator purged by the default timeout:", e)
+		}
+	}
+	b.purge(start.Add(4*b.cfg.HopTimeout.Duration + time.Second))
+	if _, ok := b.originators.originators["D"]; ok {
+		t.Error("purge: slow originator not purged by its scaled timeout")
+	}
+}
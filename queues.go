@@ -0,0 +1,220 @@
+package main
+
+import (
+	"sync"
+)
+
+// Bounded queues
+//
+// No queue between the goroutines may grow without bound, and no send may
+// block the OGM handler loop, or a slow interface could stall OGM processing
+// and deadlock the daemon. Each queue is bounded, and when full it drops by
+// an explicit policy, counting what it dropped:
+//
+//   - The outbound queue, from the OGM handler loop to the bundler, drops the
+//     oldest forwarded OGM of the originator with the most queued to make
+//     room. Our own OGMs are only dropped when nothing but own OGMs is
+//     queued, and then the oldest goes first.
+//   - Each interface's packet queue, from the bundler to its broadcaster,
+//     drops new packets of forwarded OGMs when full. A packet carrying an own
+//     OGM instead evicts the oldest queued packet.
+//   - The inbound queue, from the listeners to the OGM handler loop, drops
+//     newly received OGMs when full. The sender's next OGM will do.
+//   - The hello and probe report queues, also from the listeners to the OGM
+//     handler loop, likewise drop new hellos and reports when full. A lost
+//     hello counts as lost on the link, and the next probe round reports
+//     again.
+
+// An outboundQueue holds the OGMs to send, for the bundler to take.
+//
+// Forwarded OGMs are queued per originator, and taken round-robin across
+// originators, one OGM each per turn; as all OGMs are the same size, this is
+// deficit round-robin with a quantum of one OGM. An originator flooding the
+// queue thus only delays its own OGMs, and it is also the one whose OGMs are
+// dropped when the queue is full. Own OGMs are always taken first.
+type outboundQueue struct {
+	self  nodeID
+	limit int
+	ready chan struct{} // Signalled when OGMs are waiting
+
+	mu               sync.Mutex
+	count            int              // OGMs queued in all
+	own              []OGM            // Own OGMs, oldest first
+	flows            map[nodeID][]OGM // Forwarded OGMs by originator, oldest first
+	turns            []nodeID         // Originators with OGMs queued, in round-robin order
+	droppedOwn       uint64
+	droppedForwarded uint64
+}
+
+func newOutboundQueue(self nodeID, limit int) *outboundQueue {
+	return &outboundQueue{
+		self:  self,
+		limit: limit,
+		ready: make(chan struct{}, 1),
+		flows: make(map[nodeID][]OGM),
+	}
+}
+
+// push queues an OGM, dropping one by the queue's policy if it is full. It
+// never blocks.
+func (q *outboundQueue) push(ogm OGM) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count >= q.limit {
+		switch longest := q.longestFlow(); {
+		case longest != "":
+			q.dropOldest(longest)
+			q.droppedForwarded++
+		case ogm.Origin != q.self:
+			// Only own OGMs queued; the forwarded one gives way.
+			q.droppedForwarded++
+			return
+		default:
+			q.own = q.own[1:]
+			q.droppedOwn++
+		}
+		q.count--
+	}
+
+	if ogm.Origin == q.self {
+		q.own = append(q.own, ogm)
+	} else {
+		if len(q.flows[ogm.Origin]) == 0 {
+			q.turns = append(q.turns, ogm.Origin)
+		}
+		q.flows[ogm.Origin] = append(q.flows[ogm.Origin], ogm)
+	}
+	q.count++
+	q.signal()
+}
+
+// longestFlow returns the originator with the most forwarded OGMs queued,
+// or "" if there are none.
+func (q *outboundQueue) longestFlow() nodeID {
+	var longest nodeID
+	for _, id := range q.turns {
+		if len(q.flows[id]) > len(q.flows[longest]) {
+			longest = id
+		}
+	}
+	return longest
+}
+
+// dropOldest drops the oldest OGM queued from an originator, and takes the
+// originator out of the round-robin if none are left.
+func (q *outboundQueue) dropOldest(id nodeID) {
+	if flow := q.flows[id]; len(flow) > 1 {
+		q.flows[id] = flow[1:]
+		return
+	}
+	delete(q.flows, id)
+	for i := range q.turns {
+		if q.turns[i] == id {
+			q.turns = append(q.turns[:i], q.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// take takes up to max OGMs from the queue into buf: own OGMs first, and
+// then forwarded ones round-robin across originators. If OGMs are left, the
+// queue stays signalled.
+func (q *outboundQueue) take(buf []OGM, max int) []OGM {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	buf = buf[:0]
+	n := min(max, len(q.own))
+	buf = append(buf, q.own[:n]...)
+	q.own = q.own[n:]
+
+	for len(buf) < max && len(q.turns) > 0 {
+		id := q.turns[0]
+		q.turns = q.turns[1:]
+		flow := q.flows[id]
+		buf = append(buf, flow[0])
+		if len(flow) > 1 {
+			q.flows[id] = flow[1:]
+			q.turns = append(q.turns, id)
+		} else {
+			delete(q.flows, id)
+		}
+	}
+
+	q.count -= len(buf)
+	if q.count > 0 {
+		q.signal()
+	}
+	return buf
+}
+
+// signal marks the queue ready, unless it already is.
+func (q *outboundQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// stats returns the queue's depth and how many own and forwarded OGMs it
+// dropped.
+func (q *outboundQueue) stats() (depth int, droppedOwn, droppedForwarded uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count, q.droppedOwn, q.droppedForwarded
+}
+
+// queuePacket hands a bundle packet to its interface's broadcaster without
+// blocking, dropping by the packet queue's policy if the queue is full.
+func queuePacket(p bundlePacket) {
+	iface := p.iface
+	for {
+		select {
+		case iface.packets <- p.pkt:
+			return
+		default:
+		}
+		if !p.own {
+			iface.packetDrops.Add(1)
+			putPacketBuffer(p.pkt)
+			return
+		}
+		// Make room by evicting the oldest packet, unless the broadcaster
+		// took it first.
+		select {
+		case old := <-iface.packets:
+			iface.packetDrops.Add(1)
+			putPacketBuffer(old)
+		default:
+		}
+	}
+}
+
+// queueInbound hands a received OGM to the OGM handler loop without blocking,
+// dropping it if the inbound queue is full.
+func (b *Batman) queueInbound(ogm OGM) {
+	select {
+	case b.inboundOGM <- ogm:
+	default:
+		b.inboundDrops.Add(1)
+	}
+}
+
+// queueHello hands a received hello to the OGM handler loop without
+// blocking, dropping it if the hello queue is full.
+func (b *Batman) queueHello(h hello) {
+	select {
+	case b.inboundHello <- h:
+	default:
+		b.helloDrops.Add(1)
+	}
+}
+
+// queueProbeReport hands a received probe report to the OGM handler loop
+// without blocking, dropping it if the probe report queue is full.
+func (b *Batman) queueProbeReport(report probeReport) {
+	select {
+	case b.inboundProbeReport <- report:
+	default:
+		b.probeReportDrops.Add(1)
+	}
+}
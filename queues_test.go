@@ -0,0 +1,210 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboundQueuePolicy(t *testing.T) {
+	q := newOutboundQueue("L1", 3)
+	own := func(n int) OGM { return OGM{Origin: "L1", SQN: newDefaultSQN(n)} }
+	fwd := func(n int) OGM { return OGM{Origin: "N2", SQN: newDefaultSQN(n)} }
+	sqns := func(ogms []OGM) (out []int) {
+		for _, ogm := range ogms {
+			out = append(out, ogm.SQN.num)
+		}
+		return
+	}
+
+	// The oldest forwarded OGM makes room, even behind an own one, and own
+	// OGMs are taken first.
+	q.push(own(1))
+	q.push(fwd(2))
+	q.push(fwd(3))
+	q.push(fwd(4))
+	q.push(own(5))
+	if got := sqns(q.take(nil, 10)); len(got) != 3 || got[0] != 1 || got[1] != 5 || got[2] != 4 {
+		t.Error("outboundQueue: wrong OGMs kept:", got)
+	}
+	if depth, droppedOwn, droppedForwarded := q.stats(); depth != 0 || droppedOwn != 0 || droppedForwarded != 2 {
+		t.Error("outboundQueue: wrong stats:", depth, droppedOwn, droppedForwarded)
+	}
+
+	// With only own OGMs queued, a forwarded one gives way, and own OGMs
+	// replace the oldest own.
+	q.push(own(6))
+	q.push(own(7))
+	q.push(own(8))
+	q.push(fwd(9))
+	q.push(own(10))
+	if got := sqns(q.take(nil, 10)); len(got) != 3 || got[0] != 7 || got[2] != 10 {
+		t.Error("outboundQueue: wrong own OGMs kept:", got)
+	}
+	if _, droppedOwn, droppedForwarded := q.stats(); droppedOwn != 1 || droppedForwarded != 3 {
+		t.Error("outboundQueue: wrong drop counts:", droppedOwn, droppedForwarded)
+	}
+
+	select {
+	case <-q.ready:
+	default:
+		t.Error("outboundQueue: not signalled")
+	}
+}
+
+func TestQueuePacket(t *testing.T) {
+	iface := testInterface("10.0.0.1", defaultIfaceSettings(), true)
+	iface.packets = make(chan *[]byte, 2)
+	packet := func(tag byte, own bool) bundlePacket {
+		buf := getPacketBuffer()
+		*buf = append((*buf)[:0], tag)
+		return bundlePacket{iface, buf, own}
+	}
+
+	// Nobody takes the packets; the bundler must not block all the same.
+	done := make(chan bool)
+	go func() {
+		queuePacket(packet(1, false))
+		queuePacket(packet(2, false))
+		queuePacket(packet(3, false)) // dropped
+		queuePacket(packet(4, true))  // evicts 1
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queuePacket: blocked on a full queue")
+	}
+	if first, second := <-iface.packets, <-iface.packets; (*first)[0] != 2 || (*second)[0] != 4 {
+		t.Error("queuePacket: wrong packets kept:", *first, *second)
+	}
+	if drops := iface.packetDrops.Load(); drops != 2 {
+		t.Error("queuePacket: wrong drop count:", drops)
+	}
+}
+
+func TestRebroadcastNeverBlocks(t *testing.T) {
+	b := New(defaultConfig())
+	ogm := OGM{Origin: "N3", Sender: "N2", SQN: newDefaultSQN(1), TTL: batTTL, Quality: batTQMaxValue}
+
+	// No bundler runs, as if it were stuck behind a slow interface.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2*batOutboundQueueSize; i++ {
+			b.rebroadcast(ogm)
+		}
+		b.advertiseOGM()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("rebroadcast: blocked on a full outbound queue")
+	}
+	depth, droppedOwn, droppedForwarded := b.outbound.stats()
+	if depth != batOutboundQueueSize || droppedOwn != 0 || droppedForwarded != batOutboundQueueSize+1 {
+		t.Error("rebroadcast: wrong queue stats:", depth, droppedOwn, droppedForwarded)
+	}
+
+	// Nor does a listener block on a full inbound queue.
+	for i := 0; i < batInboundQueueSize+3; i++ {
+		b.queueInbound(ogm)
+	}
+	if drops := b.inboundDrops.Load(); drops != 3 {
+		t.Error("queueInbound: wrong drop count:", drops)
+	}
+
+	// Nor on full hello and probe report queues.
+	for i := 0; i < batHelloQueueSize+2; i++ {
+		b.queueHello(hello{})
+	}
+	for i := 0; i < batProbeReportQueueSize+4; i++ {
+		b.queueProbeReport(probeReport{})
+	}
+	if drops := b.helloDrops.Load(); drops != 2 {
+		t.Error("queueHello: wrong drop count:", drops)
+	}
+	if drops := b.probeReportDrops.Load(); drops != 4 {
+		t.Error("queueProbeReport: wrong drop count:", drops)
+	}
+}
+
+func TestOutboundQueueFairness(t *testing.T) {
+	q := newOutboundQueue("L1", 64)
+	flood := func(n int) {
+		for i := 0; i < n; i++ {
+			q.push(OGM{Origin: "N9", SQN: newDefaultSQN(i)})
+		}
+	}
+
+	// N9 floods the queue before and after the others' OGMs, and ours.
+	flood(100)
+	for _, id := range []nodeID{"N2", "N3", "N4"} {
+		q.push(OGM{Origin: id})
+	}
+	flood(100)
+	q.push(OGM{Origin: "L1"})
+
+	// The drops hit N9 alone.
+	if depth, droppedOwn, droppedForwarded := q.stats(); depth != 64 || droppedOwn != 0 || droppedForwarded != 204-64 {
+		t.Error("outboundQueue: wrong stats under flood:", depth, droppedOwn, droppedForwarded)
+	}
+
+	// The first bundle's worth has our OGM first, and the others' OGMs
+	// right after, rather than behind N9's.
+	got := q.take(nil, batMaxBundleSize)
+	if len(got) != batMaxBundleSize || got[0].Origin != "L1" {
+		t.Fatal("outboundQueue: own OGM not first:", got)
+	}
+	seen := make(map[nodeID]int)
+	for _, ogm := range got[1:] {
+		seen[ogm.Origin]++
+	}
+	if seen["N2"] != 1 || seen["N3"] != 1 || seen["N4"] != 1 {
+		t.Error("outboundQueue: flooding originator delayed the others:", seen)
+	}
+
+	// Whatever is left stays signalled for the bundler.
+	<-q.ready
+	if rest := q.take(nil, 100); len(rest) != 64-batMaxBundleSize {
+		t.Error("outboundQueue: wrong OGMs left:", len(rest))
+	}
+	select {
+	case <-q.ready:
+		t.Error("outboundQueue: empty queue signalled")
+	default:
+	}
+}
+
+func TestFloodingOriginatorBundles(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	self := nodeID("L1")
+	q := newOutboundQueue(self, batOutboundQueueSize)
+	bundler := newOGMBundler(self.raw(), 200*time.Millisecond)
+	bundler.addInterface(testInterface("10.0.0.1", defaultIfaceSettings(), true))
+
+	// N9 sends a steady flood; N2 sends one OGM in the middle of it.
+	for i := 0; i < 3*batOutboundQueueSize; i++ {
+		origin := nodeID("N9")
+		if i == batOutboundQueueSize {
+			origin = "N2"
+		}
+		q.push(OGM{Origin: origin, SQN: newDefaultSQN(i % batSQNAddrSize), TTL: batTTL})
+	}
+
+	// The bundler's first packet carries N2's OGM.
+	var out []bundlePacket
+	for len(out) == 0 {
+		for _, ogm := range q.take(nil, batMaxBundleSize) {
+			out = append(out, bundler.add(ogm.Pack(), clock.advance(time.Millisecond))...)
+		}
+	}
+	found := false
+	for _, ogms := range packetOGMs(t, out)["10.0.0.1"] {
+		for _, ogm := range ogms {
+			found = found || ogm.Origin == "N2"
+		}
+	}
+	if !found {
+		t.Error("bundler: N2's OGM delayed behind the flood")
+	}
+}
@@ -6,70 +6,502 @@ import (
 	"time"
 )
 
-// The routingTableMap holds the best next hop for each reachable node.
+// The routingTableMap holds the best next hop for each reachable node. Each
+// route names our outgoing interface along with the next hop's address, since
+// a node may be reachable through more than one of our interfaces.
 type routingTableMap map[nodeID]bestNextHop
 
-// func (table routingTableMap) String() string {
-// 	return table.String()
-// }
-
-// ToDo(Sean): Critical: Write routingTableMap update method!
-
 // ToDo(Sean): Write IP routing table update/sync method for routingTableMap
 
 // bestNextHop stores address and quality information for the routing path that
-// begins by following this link to some particular node.
+// begins by following this link to some particular node. The link's key gives
+// both the next hop's address and our interface to send through.
 type bestNextHop struct {
-	ip      ipAddr
-	quality byte
-	age     time.Duration
+	link       linkKey
+	quality    byte
+	throughput uint32
+	age        time.Duration
+}
+
+// metric returns the path's value under the given metric mode; higher is better.
+func (h bestNextHop) metric(mode string) uint32 {
+	if mode == metricThroughput {
+		return h.throughput
+	}
+	return uint32(h.quality)
 }
 
-// A routeTracker is used for tracking *all* possible routes (next hops)
-// and their scalar metric values (distance vectors) for a single destination.
+// betterThan reports whether path h should be preferred over path other.
+// Ties are broken by address, so that the choice does not depend on map order.
+func (h bestNextHop) betterThan(other bestNextHop, mode string) bool {
+	hm, om := h.metric(mode), other.metric(mode)
+	if hm != om {
+		return hm > om
+	}
+	if h.link.addr != other.link.addr {
+		return h.link.addr < other.link.addr
+	}
+	return h.link.iface < other.link.iface
+}
+
+// The originatorTable is the single store of routing state. For every other
+// node seen, it keeps our links to the node if it is a neighbor, all possible
+// next hops towards it, and a cache of the best route to it.
 //
-// Next hops are indexed by address, which in one implementation might be
-// IP address. This is because nodes are allowed to have multiple
-// addresses, some of which may be reachable in one hop (neighbors) and
-// others which are not, for the same node.
-type routeTracker struct {
-	nextHops  map[ipAddr]*hop
-	latestSQN sqn
+// All changes go through the table's methods, which keep the best route cache
+// current; the rest of the daemon reads routing state through its queries.
+type originatorTable struct {
+	self        nodeID
+	cfg         *Config
+	originators map[nodeID]*originator
+	linkIndex   map[linkKey]nodeID // Neighbor that owns each link
+	addrIndex   map[ipAddr]nodeID  // Node that owns each known address, primary or link
+	routes      routingTableMap    // Best route cache
+	switches    int                // Number of times any route changed its next hop
+	duplicates  int                // Number of OGM copies received after the first
+	loops       int                // Number of those that came around a loop
+	changes     int                // Number of links gained or lost and routes gained, lost or switched
+
+	hopPenalties map[ipAddr]byte // Hop penalty for each of our interfaces, if not the default
 }
 
-// identical to pathData
+// An originator holds everything known about a single other node.
+//
+// Next hops are indexed by link, that is by the next hop's address together
+// with our interface it is heard on. This is because nodes are allowed to
+// have multiple addresses and interfaces, some of which may be reachable in
+// one hop (neighbors) and others which are not, for the same node.
+type originator struct {
+	links        nodeLinksMap    // Our links to the node; empty unless it is a neighbor
+	primary      ipAddr          // Primary address announced in the node's OGMs
+	addrs        map[ipAddr]bool // All of the node's addresses we know of
+	nextHops     map[linkKey]*hop
+	latestSQN    sqn
+	latestSeen   time.Time     // When latestSQN arrived
+	interval     time.Duration // OGM interval the node advertised with latestSQN; 0 if unknown
+	tqWindowSize int           // Number of OGM SQNs each next hop's reported TQ is averaged over
+	dups         *dupTracker   // Copies received of the node's recent OGMs
+
+	switched time.Time // When the route last took a new next hop
+	switches int       // Number of times the route changed its next hop
+}
+
+// A hop is a possible next hop towards an originator.
 type hop struct {
-	quality  byte // A hop's self-reported quality, not considering additional local link cost
-	sqn      sqn
-	lastSeen time.Time
-	// id       nodeID
+	quality    byte        // A hop's self-reported quality, not considering additional local link cost
+	tqWindow   *windowRing // Recently reported qualities by SQN, for averaging
+	throughput uint32      // A hop's self-reported path throughput, not considering our link to it
+	sqn        sqn
+	lastSeen   time.Time
 }
 
-func newRouteTracker() *routeTracker {
-	nh := make(map[ipAddr]*hop)
-	return &routeTracker{nextHops: nh, latestSQN: sqn{}}
+// averageTQ returns the average of the qualities reported via the hop over
+// the recent window of SQNs. SQNs not heard via the hop are left out, rather
+// than counted as zero; loss on our link to the hop is the link TQ's business.
+func (h *hop) averageTQ() byte {
+	count := h.tqWindow.countHitsFunc(func(v byte) bool { return v != 0 })
+	if count == 0 {
+		return 0
+	}
+	return byte(h.tqWindow.sum() / count)
 }
 
-func (r *routeTracker) String() string {
+func newOriginatorTable(self nodeID, cfg *Config) *originatorTable {
+	return &originatorTable{
+		self:        self,
+		cfg:         cfg,
+		originators: make(map[nodeID]*originator),
+		linkIndex:   make(map[linkKey]nodeID),
+		addrIndex:   make(map[ipAddr]nodeID),
+		routes:      make(routingTableMap),
+	}
+}
+
+func newOriginator(tqWindowSize int) *originator {
+	return &originator{
+		links:        newNodeLinkMap(),
+		addrs:        make(map[ipAddr]bool),
+		nextHops:     make(map[linkKey]*hop),
+		tqWindowSize: tqWindowSize,
+		dups:         newDupTracker(batDupWindowSize),
+	}
+}
+
+func (o *originator) String() string {
 	var buf bytes.Buffer
-	for key, v := range r.nextHops {
-		fmt.Fprintf(&buf, "%s: Quality=%d, SQN=%v, Age=%d, ", key, v.quality, v.sqn, time.Since(v.lastSeen))
+	for key, v := range o.nextHops {
+		fmt.Fprintf(&buf, "%s: Quality=%d, AvgQuality=%d, Throughput=%d, SQN=%v, Age=%d, ", key, v.quality, v.averageTQ(), v.throughput, v.sqn, time.Since(v.lastSeen))
 	}
-	return fmt.Sprintf("{routeTracker: SQN=%s, %s}", r.latestSQN.String(), buf.String())
+	return fmt.Sprintf("{originator: Primary=%s, SQN=%s, Interval=%v, Links=%d, Switches=%d, %s}", o.primary, o.latestSQN.String(), o.interval, len(o.links), o.switches, buf.String())
 }
 
-func (r *routeTracker) update(ip ipAddr, sqn sqn, quality byte, when time.Time) {
-	if _, ok := r.nextHops[ip]; !ok {
-		r.nextHops[ip] = &hop{quality, sqn, when}
+// updateHop records what an OGM received via the given next hop reported.
+func (o *originator) updateHop(key linkKey, sqn sqn, quality byte, throughput uint32, when time.Time) {
+	if _, ok := o.nextHops[key]; !ok {
+		tqWindow := newWindowRing(batSQNAddrSize, o.tqWindowSize, 0)
+		o.nextHops[key] = &hop{quality, tqWindow, throughput, sqn, when}
+	}
+	if sqn.greaterThan(o.latestSQN) {
+		o.latestSQN = sqn
+		o.latestSeen = when
 	}
-	if sqn.greaterThan(r.latestSQN) {
-		r.latestSQN = sqn
+	hopPtr := o.nextHops[key]
+	newer := sqn.greaterThan(hopPtr.sqn) || sqn.equalTo(hopPtr.sqn)
+	if newer || hopPtr.tqWindow.inWindow(sqn.num) {
+		hopPtr.tqWindow.write(sqn.num, quality) // Late OGMs still count towards the average
 	}
-	hopPtr := r.nextHops[ip]
-	if sqn.greaterThan(hopPtr.sqn) || sqn.equalTo(hopPtr.sqn) {
+	if newer {
 		hopPtr.quality = quality
+		hopPtr.throughput = throughput
 		hopPtr.sqn = sqn
 		hopPtr.lastSeen = when
 	}
 	// ToDo(Sean): Add check on lastSeen to keep newest when equal
 }
+
+// expectedSQN returns the SQN the node should have reached by now, judging
+// by its advertised OGM interval.
+func (o *originator) expectedSQN(now time.Time) sqn {
+	if o.interval <= 0 || !now.After(o.latestSeen) {
+		return o.latestSQN
+	}
+	expected := o.latestSQN
+	expected.num = pmod(expected.num+int(now.Sub(o.latestSeen)/o.interval), batSQNAddrSize)
+	return expected
+}
+
+// scaled scales a timeout meant for a node sending OGMs every reference
+// interval to the node's advertised OGM interval.
+func (o *originator) scaled(timeout, reference time.Duration) time.Duration {
+	if o.interval <= 0 || reference <= 0 {
+		return timeout
+	}
+	return time.Duration(float64(timeout) * float64(o.interval) / float64(reference))
+}
+
+// decayHops moves every next hop's TQ window to the SQN the node should have
+// reached by now, so that the TQ averaged via next hops that stopped
+// forwarding the node's OGMs, or via all of them if the node went silent,
+// falls one missed OGM at a time.
+func (o *originator) decayHops(now time.Time) {
+	expected := o.expectedSQN(now)
+	for _, h := range o.nextHops {
+		h.tqWindow.advance(expected.num)
+	}
+}
+
+// Update API //
+
+// get returns the originator entry for id, creating it if needed.
+func (t *originatorTable) get(id nodeID) *originator {
+	o, ok := t.originators[id]
+	if !ok {
+		o = newOriginator(t.cfg.TQWindowSize)
+		t.originators[id] = o
+	}
+	return o
+}
+
+// link returns our link to neighbor id with the given key, creating the
+// neighbor and the link if needed.
+func (t *originatorTable) link(id nodeID, key linkKey) *linkData {
+	o := t.get(id)
+	if _, ok := o.links[key]; !ok {
+		if owner, taken := t.linkIndex[key]; taken && owner != id {
+			t.removeLink(owner, key)
+		}
+		o.links.addLink(key, t.cfg.WindowSize)
+		t.linkIndex[key] = id
+		t.changes++
+		t.addAddr(id, key.addr)
+	}
+	return o.links[key]
+}
+
+// announce records the primary address that originator id announces in its
+// OGMs. OGMs from any of a node's interfaces carry the same primary address,
+// which ties them all to the one originator.
+func (t *originatorTable) announce(id nodeID, primary ipAddr) {
+	if id == t.self || primary == "" || primary == "0.0.0.0" {
+		return
+	}
+	t.get(id).primary = primary
+	t.addAddr(id, primary)
+}
+
+// addAddr indexes an address as belonging to node id, taking it away from
+// any other node.
+func (t *originatorTable) addAddr(id nodeID, addr ipAddr) {
+	if owner, taken := t.addrIndex[addr]; taken && owner != id {
+		if o, ok := t.originators[owner]; ok {
+			delete(o.addrs, addr)
+		}
+	}
+	t.get(id).addrs[addr] = true
+	t.addrIndex[addr] = id
+}
+
+// forget removes originator id, with its links and addresses, from the table.
+func (t *originatorTable) forget(id nodeID) {
+	if o, ok := t.originators[id]; ok {
+		for key := range o.links {
+			t.removeLink(id, key)
+		}
+		for addr := range o.addrs {
+			if t.addrIndex[addr] == id {
+				delete(t.addrIndex, addr)
+			}
+		}
+	}
+	delete(t.originators, id)
+}
+
+// removeLink forgets a neighbor link.
+func (t *originatorTable) removeLink(id nodeID, key linkKey) {
+	if o, ok := t.originators[id]; ok && o.links[key] != nil {
+		delete(o.links, key)
+		t.changes++
+		t.dropAddr(o, id, key.addr)
+	}
+	if t.linkIndex[key] == id {
+		delete(t.linkIndex, key)
+	}
+}
+
+// dropAddr unindexes node id's address addr once no link to it is left, so
+// that the address is free for whichever node uses it next.
+func (t *originatorTable) dropAddr(o *originator, id nodeID, addr ipAddr) {
+	for key := range o.links {
+		if key.addr == addr {
+			return
+		}
+	}
+	delete(o.addrs, addr)
+	if t.addrIndex[addr] == id {
+		delete(t.addrIndex, addr)
+	}
+}
+
+// updatePath is the single path by which OGMs update route state. It records
+// what the OGM reported via the given next hop link and reselects the route.
+func (t *originatorTable) updatePath(id nodeID, key linkKey, sqn sqn, quality byte, throughput uint32, when time.Time) {
+	if id == t.self {
+		return
+	}
+	t.get(id).updateHop(key, sqn, quality, throughput, when)
+	t.selectRoute(id, when)
+}
+
+// recordCopy records a copy of an OGM from originator id received through
+// the given link, counting it if it is a duplicate.
+func (t *originatorTable) recordCopy(id nodeID, key linkKey, sqn sqn) dupResult {
+	dup := t.get(id).dups.record(sqn, key)
+	if dup.copies > 1 {
+		t.duplicates++
+	}
+	if dup.repeat {
+		t.loops++
+	}
+	return dup
+}
+
+// markForwarded records that a copy of originator id's OGM was forwarded.
+func (t *originatorTable) markForwarded(id nodeID, sqn sqn) {
+	t.get(id).dups.markForwarded(sqn)
+}
+
+// advertised records the OGM interval originator id advertised in an OGM
+// with the given SQN, if that is its latest.
+func (t *originatorTable) advertised(id nodeID, sqn sqn, interval time.Duration) {
+	if o, ok := t.originators[id]; ok && sqn.equalTo(o.latestSQN) {
+		o.interval = interval
+	}
+}
+
+// refreshRoutes reselects the best route to every originator.
+func (t *originatorTable) refreshRoutes(now time.Time) {
+	for id := range t.originators {
+		t.selectRoute(id, now)
+	}
+}
+
+// Query API //
+
+// route returns the best route to id.
+func (t *originatorTable) route(id nodeID) (bestNextHop, bool) {
+	best, ok := t.routes[id]
+	return best, ok
+}
+
+// wasForwarded reports whether a copy of originator id's OGM was forwarded.
+func (t *originatorTable) wasForwarded(id nodeID, sqn sqn) bool {
+	o, ok := t.originators[id]
+	return ok && o.dups.wasForwarded(sqn)
+}
+
+// isNeighbor reports whether we have a link to id.
+func (t *originatorTable) isNeighbor(id nodeID) bool {
+	o, ok := t.originators[id]
+	return ok && len(o.links) > 0
+}
+
+// originatorOf finds the node that owns an address, be it the node's primary
+// address or one of its link addresses.
+func (t *originatorTable) originatorOf(addr ipAddr) (nodeID, bool) {
+	id, ok := t.addrIndex[addr]
+	return id, ok
+}
+
+// acceptClaim reports whether a packet from addr may be taken to come from
+// node claimed. An address known to belong to another node stays with it
+// while that node is heard on it: a stray or forged claim does not take a
+// link over, which would reset it. Once the owner has been silent on the
+// address for LinkTimeout, the claim wins, as when a robot has taken over
+// the address of one that left.
+func (t *originatorTable) acceptClaim(claimed nodeID, addr ipAddr, now time.Time) bool {
+	owner, ok := t.originatorOf(addr)
+	if !ok || owner == claimed {
+		return true
+	}
+	for key, link := range t.originators[owner].links {
+		if key.addr == addr && now.Sub(link.heard) <= t.cfg.LinkTimeout.Duration {
+			return false
+		}
+	}
+	return true
+}
+
+// linkFrom finds the neighbor and link data for a packet from a neighbor's
+// address, received on one of our interfaces: the link to that address, or
+// else the one link on the interface to the node that owns the address. A
+// neighbor with several addresses may answer from another one than we heard
+// it on.
+func (t *originatorTable) linkFrom(key linkKey) (nodeID, *linkData, bool) {
+	if id, link, ok := t.linkTo(key); ok {
+		return id, link, true
+	}
+	id, ok := t.originatorOf(key.addr)
+	if !ok {
+		return "", nil, false
+	}
+	var found *linkData
+	for other, link := range t.originators[id].links {
+		if other.iface != key.iface {
+			continue
+		} else if found != nil {
+			return "", nil, false // Ambiguous
+		}
+		found = link
+	}
+	return id, found, found != nil
+}
+
+// hopPenalty returns the hop penalty for paths through neighbors heard on our
+// interface iface.
+func (t *originatorTable) hopPenalty(iface ipAddr) byte {
+	if penalty, ok := t.hopPenalties[iface]; ok {
+		return penalty
+	}
+	return batTQHopPenalty
+}
+
+// linkTo finds the neighbor and link data for a link key.
+func (t *originatorTable) linkTo(key linkKey) (nodeID, *linkData, bool) {
+	id, ok := t.linkIndex[key]
+	if !ok {
+		return "", nil, false
+	}
+	link, ok := t.originators[id].links[key]
+	return id, link, ok
+}
+
+// forEachLink calls f for every neighbor link.
+func (t *originatorTable) forEachLink(f func(id nodeID, key linkKey, link *linkData)) {
+	for key, id := range t.linkIndex {
+		f(id, key, t.originators[id].links[key])
+	}
+}
+
+// Route selection //
+
+// selectRoute picks the best next hop towards a single node according to the
+// configured metric, or removes the node's route if no next hop is usable.
+//
+// A usable current next hop is kept unless the best one beats it by the
+// configured switch margin, and then only once the current one has been held
+// for the minimum hold time. This keeps small metric fluctuations from
+// flipping routes back and forth.
+func (t *originatorTable) selectRoute(id nodeID, now time.Time) {
+	previous, routed := t.routes[id]
+	o, ok := t.originators[id]
+	if !ok || id == t.self {
+		if routed {
+			delete(t.routes, id)
+			t.changes++
+		}
+		return
+	}
+
+	var best, current bestNextHop
+	found, haveCurrent := false, false
+	for key, h := range o.nextHops {
+		path := t.pathVia(key, h, now)
+		if path.metric(t.cfg.Metric) == 0 {
+			continue
+		}
+		if routed && key == previous.link {
+			current = path
+			haveCurrent = true
+		}
+		if !found || path.betterThan(best, t.cfg.Metric) {
+			best = path
+			found = true
+		}
+	}
+
+	switch {
+	case !found:
+		if routed {
+			delete(t.routes, id)
+			t.changes++
+		}
+	case haveCurrent && !t.worthSwitching(current, best, now.Sub(o.switched)):
+		t.routes[id] = current
+	default:
+		if !routed || best.link != previous.link {
+			if routed {
+				o.switches++
+				t.switches++
+			}
+			o.switched = now
+			t.changes++
+		}
+		t.routes[id] = best
+	}
+}
+
+// worthSwitching decides whether to give up the current next hop, held for
+// the given time, in favor of the best one.
+func (t *originatorTable) worthSwitching(current, best bestNextHop, held time.Duration) bool {
+	if best.link == current.link || held < t.cfg.SwitchHoldTime.Duration {
+		return false
+	}
+	currentMetric := uint64(current.metric(t.cfg.Metric))
+	margin := currentMetric * uint64(t.cfg.SwitchMarginPercent) / 100
+	if uint64(t.cfg.SwitchMargin) > margin {
+		margin = uint64(t.cfg.SwitchMargin)
+	}
+	return uint64(best.metric(t.cfg.Metric)) > currentMetric+margin
+}
+
+// pathVia evaluates the route that begins with the given next hop link,
+// taking our own link to that next hop into account.
+func (t *originatorTable) pathVia(key linkKey, h *hop, now time.Time) bestNextHop {
+	path := bestNextHop{link: key, age: now.Sub(h.lastSeen)}
+	if _, link, ok := t.linkTo(key); ok {
+		penalty := t.hopPenalty(key.iface)
+		path.quality = pathTQ(h.averageTQ(), link.tq, penalty)
+		path.throughput = pathThroughput(h.throughput, t.linkThroughput(key, link), penalty)
+	}
+	return path
+}
@@ -5,13 +5,6 @@ import (
 	"time"
 )
 
-// func TestRouteTracker(t *testing.T) {
-// 	var rm *routingMetric
-
-// 	rt = newRouteTracker()
-// 	rt.nextHops['10.0.0.3'] =
-// }
-
 func TestIpAddrRaw(t *testing.T) {
 	var ip ipAddr = "10.1.6.3"
 
@@ -24,15 +17,222 @@ func TestIpAddrRaw(t *testing.T) {
 	}
 }
 
-func TestRouteTracker(t *testing.T) {
-	rt := newRouteTracker()
+func TestOriginatorUpdateHop(t *testing.T) {
+	o := newOriginator(batTQGlobalWindowSize)
+
+	o.updateHop(testLink("192.168.1.1"), newDefaultSQN(5), 200, 0, time.Now())
+	o.updateHop(testLink("192.168.1.1"), newDefaultSQN(6), 200, 0, time.Now())
+
+	if !o.latestSQN.equalTo(newDefaultSQN(6)) {
+		t.Error("originator updateHop error: Latest SQN:", o.String())
+	}
+
+	// An older OGM does not overwrite a newer one.
+	o.updateHop(testLink("192.168.1.1"), newDefaultSQN(4), 100, 0, time.Now())
+	if h := o.nextHops[testLink("192.168.1.1")]; h.quality != 200 || !h.sqn.equalTo(newDefaultSQN(6)) {
+		t.Error("originator updateHop error: stale OGM applied:", o.String())
+	}
+}
+
+func TestOriginatorTable(t *testing.T) {
+	cfg := defaultConfig()
+	table := newOriginatorTable("L1", &cfg)
+
+	// OGMs about ourselves are never tracked.
+	table.updatePath("L1", testLink("10.0.0.2"), newDefaultSQN(1), batTQMaxValue, 0, time.Now())
+	if _, ok := table.originators["L1"]; ok {
+		t.Error("originatorTable: own node tracked as originator")
+	}
+
+	// A link address moving to another node is taken away from the first.
+	table.link("N2", testLink("10.0.0.2"))
+	table.link("N3", testLink("10.0.0.2"))
+	if id, _, ok := table.linkTo(testLink("10.0.0.2")); !ok || id != "N3" || table.isNeighbor("N2") {
+		t.Error("originatorTable: link address owned by two neighbors:", id, ok)
+	}
+
+	// Without a usable link, a next hop offers no route.
+	table.updatePath("D", testLink("10.0.0.9"), newDefaultSQN(1), batTQMaxValue, 0, time.Now())
+	if _, ok := table.route("D"); ok {
+		t.Error("originatorTable: route via unknown link")
+	}
+}
+
+func TestRouteOutgoingInterface(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SwitchHoldTime.Duration = 0
+	b := New(cfg)
+	table := b.originators
+
+	// The same neighbor address heard on two of our interfaces gives two
+	// separate links and next hops.
+	fast := linkKey{"10.0.0.1", "10.0.0.2"}
+	slow := linkKey{"10.1.0.1", "10.0.0.2"}
+	table.link("N2", fast).tq = batTQMaxValue
+	table.link("N2", slow).tq = batTQMaxValue / 2
+	if n := len(table.get("N2").links); n != 2 {
+		t.Fatal("route: links on different interfaces merged:", n)
+	}
+
+	table.updatePath("D", fast, newDefaultSQN(1), 200, 0, time.Now())
+	table.updatePath("D", slow, newDefaultSQN(1), 200, 0, time.Now())
+	if best, ok := table.route("D"); !ok || best.link != fast {
+		t.Error("route: wrong outgoing interface:", best)
+	}
+}
+
+func TestRouteHysteresis(t *testing.T) {
+	b := New(defaultConfig())
+	newTestNeighbor(&b, "N2", "10.0.0.2", batLocalWindowSize).tq = batTQMaxValue
+	newTestNeighbor(&b, "N3", "10.0.0.3", batLocalWindowSize).tq = batTQMaxValue
+
+	table := b.originators
+	table.updatePath("D", testLink("10.0.0.2"), newDefaultSQN(1), 200, 0, time.Now())
+	table.updatePath("D", testLink("10.0.0.3"), newDefaultSQN(1), 190, 0, time.Now())
+	rt := table.get("D")
+	if table.routes["D"].link != testLink("10.0.0.2") {
+		t.Error("hysteresis: initial route not the best:", table.routes["D"])
+	}
+
+	// A slightly better next hop is not worth a switch.
+	table.updatePath("D", testLink("10.0.0.3"), newDefaultSQN(2), 205, 0, time.Now())
+	if table.routes["D"].link != testLink("10.0.0.2") {
+		t.Error("hysteresis: switched within margin:", table.routes["D"])
+	}
+
+	// A much better next hop must wait for the hold time.
+	table.updatePath("D", testLink("10.0.0.3"), newDefaultSQN(3), 250, 0, time.Now())
+	if table.routes["D"].link != testLink("10.0.0.2") {
+		t.Error("hysteresis: switched within hold time:", table.routes["D"])
+	}
+	rt.switched = time.Now().Add(-b.cfg.SwitchHoldTime.Duration)
+	table.selectRoute("D", time.Now())
+	if table.routes["D"].link != testLink("10.0.0.3") || rt.switches != 1 || table.switches != 1 {
+		t.Error("hysteresis: did not switch after hold time:", table.routes["D"], rt.switches)
+	}
+
+	// Losing the current next hop switches right away.
+	table.get("N3").links[testLink("10.0.0.3")].tq = 0
+	table.selectRoute("D", time.Now())
+	if table.routes["D"].link != testLink("10.0.0.2") || rt.switches != 2 {
+		t.Error("hysteresis: kept an unusable next hop:", table.routes["D"], rt.switches)
+	}
+}
+
+func TestHopAverageTQ(t *testing.T) {
+	o := newOriginator(4)
+	ip := testLink("10.0.0.2")
+
+	o.updateHop(ip, newDefaultSQN(1), 200, 0, time.Now())
+	o.updateHop(ip, newDefaultSQN(2), 100, 0, time.Now())
+	o.updateHop(ip, newDefaultSQN(4), 150, 0, time.Now()) // SQN 3 was missed
+	if avg := o.nextHops[ip].averageTQ(); avg != 150 {
+		t.Error("hop averageTQ error: wrong average:", avg)
+	}
+
+	// A late OGM still counts, but does not become the latest report.
+	o.updateHop(ip, newDefaultSQN(3), 250, 0, time.Now())
+	if h := o.nextHops[ip]; h.averageTQ() != 175 || h.quality != 150 {
+		t.Error("hop averageTQ error: late OGM:", h.averageTQ(), h.quality)
+	}
+
+	// Old reports slide out of the window.
+	o.updateHop(ip, newDefaultSQN(8), 40, 0, time.Now())
+	if avg := o.nextHops[ip].averageTQ(); avg != 40 {
+		t.Error("hop averageTQ error: window did not slide:", avg)
+	}
+}
+
+func TestSelectRouteAverageTQ(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SwitchHoldTime.Duration = 0
+	b := New(cfg)
+	newTestNeighbor(&b, "N2", "10.0.0.2", batLocalWindowSize).tq = batTQMaxValue
+	newTestNeighbor(&b, "N3", "10.0.0.3", batLocalWindowSize).tq = batTQMaxValue
+
+	table := b.originators
+	for i := 1; i <= batTQGlobalWindowSize; i++ {
+		table.updatePath("D", testLink("10.0.0.2"), newDefaultSQN(i), 200, 0, time.Now())
+		table.updatePath("D", testLink("10.0.0.3"), newDefaultSQN(i), 150, 0, time.Now())
+	}
+	// One lucky OGM does not decide the route.
+	table.updatePath("D", testLink("10.0.0.3"), newDefaultSQN(batTQGlobalWindowSize+1), 255, 0, time.Now())
+	if best, _ := table.route("D"); best.link != testLink("10.0.0.2") {
+		t.Error("selectRoute: route decided by a single OGM:", best)
+	}
+}
 
-	rt.update(ipAddr("192.168.1.1"), newDefaultSQN(5), 200, time.Now())
-	rt.update(ipAddr("192.168.1.1"), newDefaultSQN(6), 200, time.Now())
+func TestOriginatorAddresses(t *testing.T) {
+	cfg := defaultConfig()
+	table := newOriginatorTable("L1", &cfg)
 
-	if !rt.latestSQN.equalTo(newDefaultSQN(6)) {
-		t.Error("RouteTracker update error: Latest SQN:", rt.String())
+	// A neighbor's primary address and the addresses of its links all map
+	// to the one originator.
+	table.announce("N2", "10.9.0.2")
+	table.link("N2", linkKey{"10.0.0.1", "10.0.0.2"})
+	table.link("N2", linkKey{"10.1.0.1", "10.1.0.2"})
+	for _, addr := range []ipAddr{"10.9.0.2", "10.0.0.2", "10.1.0.2"} {
+		if id, ok := table.originatorOf(addr); !ok || id != "N2" {
+			t.Error("originatorTable: address not mapped to its node:", addr, id)
+		}
+	}
+	if table.get("N2").primary != "10.9.0.2" {
+		t.Error("originatorTable: primary address not recorded:", table.get("N2"))
 	}
 
-	// ToDo(Sean): Add test cases for remaining update RouteTracker tasks.
+	// Our own announcements and empty addresses are ignored.
+	table.announce("L1", "10.9.0.1")
+	table.announce("D", "0.0.0.0")
+	if _, ok := table.originatorOf("10.9.0.1"); ok {
+		t.Error("originatorTable: own address mapped")
+	}
+	if _, ok := table.originatorOf("0.0.0.0"); ok {
+		t.Error("originatorTable: empty address mapped")
+	}
+
+	// Losing the last link to an address frees it.
+	table.removeLink("N2", linkKey{"10.1.0.1", "10.1.0.2"})
+	if _, ok := table.originatorOf("10.1.0.2"); ok || table.get("N2").addrs["10.1.0.2"] {
+		t.Error("originatorTable: address of removed link still mapped")
+	}
+
+	// Forgetting the node forgets its addresses.
+	table.forget("N2")
+	if _, ok := table.originatorOf("10.0.0.2"); ok {
+		t.Error("originatorTable: address of forgotten node still mapped")
+	}
+}
+
+func TestAdvertisedInterval(t *testing.T) {
+	cfg := defaultConfig()
+	table := newOriginatorTable("L1", &cfg)
+	key := testLink("10.0.0.2")
+	table.link("N2", key).tq = batTQMaxValue
+	start := time.Now()
+
+	// Only the interval advertised with the latest SQN counts.
+	table.updatePath("D", key, newDefaultSQN(10), 200, 0, start)
+	table.advertised("D", newDefaultSQN(10), 2*time.Second)
+	table.updatePath("D", key, newDefaultSQN(9), 200, 0, start)
+	table.advertised("D", newDefaultSQN(9), time.Second)
+	o := table.get("D")
+	if o.interval != 2*time.Second {
+		t.Error("originator: interval of a late OGM recorded:", o.interval)
+	}
+
+	// SQNs are expected to progress at the node's own pace.
+	if sqn := o.expectedSQN(start.Add(7 * time.Second)); sqn.num != 13 {
+		t.Error("originator: wrong expected SQN:", sqn)
+	}
+
+	// The TQ via the next hop decays as the node's OGMs go missing, over
+	// the TQ window counted in the node's own OGMs.
+	o.decayHops(start.Add(time.Duration(batTQGlobalWindowSize-1) * 2 * time.Second))
+	if avg := o.nextHops[key].averageTQ(); avg != 200 {
+		t.Error("originator: TQ decayed before the window passed:", avg)
+	}
+	o.decayHops(start.Add(time.Duration(batTQGlobalWindowSize+1) * 2 * time.Second))
+	if avg := o.nextHops[key].averageTQ(); avg != 0 {
+		t.Error("originator: TQ of a silent node not decayed:", avg)
+	}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Kernel receive timestamps
+//
+// Packets can wait a long time between arriving and being handled, most of
+// all under load, when the listeners block on the OGM handler loop. With
+// SO_TIMESTAMPNS, the kernel stamps each packet as it arrives, and passes the
+// stamp along in a control message. Link and route state is updated with that
+// time, and only with the time of reading the packet if there is none.
+
+// rxOOBSize is room for the control messages a listener asks for: the
+// receive timestamp, and the packet info in single socket mode.
+var rxOOBSize = syscall.CmsgSpace(sizeofTimespec) + syscall.CmsgSpace(syscall.SizeofInet4Pktinfo)
+
+const sizeofTimespec = int(unsafe.Sizeof(syscall.Timespec{}))
+
+// enableRxTimestamps asks the kernel to stamp the packets received on conn.
+func enableRxTimestamps(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("enableRxTimestamps: %v", err)
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("enableRxTimestamps: SO_TIMESTAMPNS: %v", err)
+	}
+	return nil
+}
+
+// rxTimestamp returns the kernel receive timestamp among the control messages
+// received with a packet, or the given fallback time if there is none. The
+// fallback is when the packet was read, and the stamp is rebased onto its
+// monotonic clock reading, so that wall clock steps, as when NTP first syncs,
+// do not skew link and route times.
+func rxTimestamp(oob []byte, fallback time.Time) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return fallback
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMPNS && len(m.Data) >= sizeofTimespec {
+			ts := *(*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+			if age := fallback.Sub(time.Unix(ts.Unix())); age > 0 {
+				return fallback.Add(-age)
+			}
+			return fallback
+		}
+	}
+	return fallback
+}
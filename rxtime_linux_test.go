@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestRxTimestamps(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("rxTimestamp: no loopback socket:", err)
+	}
+	defer conn.Close()
+	if err := enableRxTimestamps(conn); err != nil {
+		t.Fatal("rxTimestamp:", err)
+	}
+	sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal("rxTimestamp: sender:", err)
+	}
+	defer sender.Close()
+
+	// The packet waits a while before it is read; its time is when it arrived.
+	sent := time.Now()
+	sender.Write([]byte{batPacketHello})
+	time.Sleep(50 * time.Millisecond)
+	read := packetReaderFactory(conn, "127.0.0.1", func(ipAddr) bool { return false })
+	d, err := read()
+	if err != nil {
+		t.Fatal("rxTimestamp: read:", err)
+	}
+	if lag := d.rxTime.Sub(sent); lag < 0 || lag > 25*time.Millisecond {
+		t.Error("rxTimestamp: kernel timestamp not used:", lag)
+	}
+
+	// Without a timestamp, the fallback is used.
+	fallback := time.Unix(42, 0)
+	if ts := rxTimestamp(nil, fallback); !ts.Equal(fallback) {
+		t.Error("rxTimestamp: fallback not used:", ts)
+	}
+}
+
+// timestampOOB builds the SCM_TIMESTAMPNS control message the kernel would
+// pass along with a packet received at the given time.
+func timestampOOB(at time.Time) []byte {
+	oob := make([]byte, syscall.CmsgSpace(sizeofTimespec))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.SOL_SOCKET
+	h.Type = syscall.SCM_TIMESTAMPNS
+	h.SetLen(syscall.CmsgLen(sizeofTimespec))
+	*(*syscall.Timespec)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = syscall.NsecToTimespec(at.UnixNano())
+	return oob
+}
+
+func TestRxTimestampMonotonic(t *testing.T) {
+	now := time.Now()
+
+	// The stamp keeps its age, on the monotonic clock.
+	ts := rxTimestamp(timestampOOB(now.Add(-10*time.Millisecond)), now)
+	if now.Sub(ts) != 10*time.Millisecond || !strings.Contains(ts.String(), "m=") {
+		t.Error("rxTimestamp: stamp not rebased onto the monotonic clock:", ts)
+	}
+
+	// A stamp from the future, as after the wall clock stepped back, is
+	// clamped to the time of reading.
+	if ts := rxTimestamp(timestampOOB(now.Add(time.Hour)), now); ts != now {
+		t.Error("rxTimestamp: stamp after the time of reading:", ts)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Without SO_TIMESTAMPNS, packets are stamped with the time they are read.
+
+// rxOOBSize is room for the control messages a listener asks for: none.
+const rxOOBSize = 0
+
+func enableRxTimestamps(conn *net.UDPConn) error {
+	return nil
+}
+
+func rxTimestamp(oob []byte, fallback time.Time) time.Time {
+	return fallback
+}
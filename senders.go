@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Sender rate limits and quarantine
+//
+// Nothing in the protocol stops a neighbor from sending thousands of OGMs a
+// second, or a stream of malformed packets. The listeners check every packet
+// against its sender's address before passing it on: each sender has a token
+// bucket, refilled at SenderRate tokens a second up to SenderBurst, and each
+// OGM, or other packet, takes a token. What a sender sends without tokens is
+// dropped. A sender that sends MalformedLimit malformed packets within
+// MalformedWindow is quarantined, and all its packets are dropped, for
+// QuarantineTime.
+
+// A senderGuard keeps the rate limits and quarantine of all senders. It is
+// shared by the listeners, and safe for concurrent use.
+type senderGuard struct {
+	rate            float64 // Tokens per second
+	burst           float64
+	malformedLimit  int
+	malformedWindow time.Duration
+	quarantineTime  time.Duration
+
+	mu        sync.Mutex
+	senders   map[ipAddr]*senderState
+	lastSweep time.Time
+	stats     senderStats
+}
+
+// senderStats counts what the senderGuard rejected.
+type senderStats struct {
+	rateLimited uint64 // OGMs and other packets beyond a sender's rate
+	malformed   uint64 // Malformed packets
+	quarantined uint64 // Packets from quarantined senders
+}
+
+// A senderState is the rate limit and quarantine state of one sender.
+type senderState struct {
+	seen             time.Time // When the sender was last heard from
+	tokens           float64
+	refilled         time.Time
+	malformed        int // Malformed packets since malformedSince
+	malformedSince   time.Time
+	quarantinedUntil time.Time
+}
+
+func newSenderGuard(cfg *Config) *senderGuard {
+	return &senderGuard{
+		rate:            float64(cfg.SenderRate),
+		burst:           float64(cfg.SenderBurst),
+		malformedLimit:  cfg.MalformedLimit,
+		malformedWindow: cfg.MalformedWindow.Duration,
+		quarantineTime:  cfg.QuarantineTime.Duration,
+		senders:         make(map[ipAddr]*senderState),
+	}
+}
+
+// sender returns the state of a sender, starting it with a full bucket. Now
+// and then, senders that have been idle long enough to be back at a full
+// bucket with no malformed packets in the window, and are not quarantined,
+// are forgotten.
+func (g *senderGuard) sender(addr ipAddr, now time.Time) *senderState {
+	idle := time.Duration(g.burst/g.rate*float64(time.Second)) + g.malformedWindow
+	if now.Sub(g.lastSweep) > idle {
+		g.lastSweep = now
+		for a, s := range g.senders {
+			if now.Sub(s.seen) > idle && now.After(s.quarantinedUntil) {
+				delete(g.senders, a)
+			}
+		}
+	}
+	s, ok := g.senders[addr]
+	if !ok {
+		s = &senderState{tokens: g.burst, refilled: now}
+		g.senders[addr] = s
+	}
+	s.seen = now
+	return s
+}
+
+// admit reports whether a packet from the sender may be looked at: it is
+// false while the sender is quarantined.
+func (g *senderGuard) admit(addr ipAddr, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s, ok := g.senders[addr]; ok && now.Before(s.quarantinedUntil) {
+		g.stats.quarantined++
+		return false
+	}
+	return true
+}
+
+// allow takes up to n tokens from the sender's bucket, one for each OGM of a
+// bundle or for another packet, and returns how many it got.
+func (g *senderGuard) allow(addr ipAddr, n int, now time.Time) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.sender(addr, now)
+	if elapsed := now.Sub(s.refilled); elapsed > 0 {
+		s.tokens = math.Min(g.burst, s.tokens+elapsed.Seconds()*g.rate)
+		s.refilled = now
+	}
+	allowed := min(n, int(s.tokens))
+	s.tokens -= float64(allowed)
+	g.stats.rateLimited += uint64(n - allowed)
+	return allowed
+}
+
+// reportMalformed counts a malformed packet from the sender, and quarantines
+// the sender if it sent too many of them lately. It reports whether the
+// sender was quarantined.
+func (g *senderGuard) reportMalformed(addr ipAddr, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stats.malformed++
+	s := g.sender(addr, now)
+	if now.Sub(s.malformedSince) > g.malformedWindow {
+		s.malformed, s.malformedSince = 0, now
+	}
+	s.malformed++
+	if s.malformed < g.malformedLimit {
+		return false
+	}
+	s.malformed = 0
+	s.quarantinedUntil = now.Add(g.quarantineTime)
+	return true
+}
+
+// quarantine returns the senders in quarantine, with when they are let out.
+func (g *senderGuard) quarantine(now time.Time) map[ipAddr]time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make(map[ipAddr]time.Time)
+	for addr, s := range g.senders {
+		if now.Before(s.quarantinedUntil) {
+			out[addr] = s.quarantinedUntil
+		}
+	}
+	return out
+}
+
+// rejected returns the counts of what was rejected so far.
+func (g *senderGuard) rejected() senderStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
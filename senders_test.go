@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testSenderGuard() *senderGuard {
+	cfg := defaultConfig()
+	cfg.SenderRate = 10
+	cfg.SenderBurst = 20
+	cfg.MalformedLimit = 3
+	cfg.MalformedWindow = duration{10 * time.Second}
+	cfg.QuarantineTime = duration{time.Minute}
+	return newSenderGuard(&cfg)
+}
+
+func TestSenderRateLimit(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	g := testSenderGuard()
+
+	// A new sender gets its burst, and a bundle beyond it is cut short.
+	if n := g.allow("10.0.0.2", 15, clock.now); n != 15 {
+		t.Error("allow: burst not allowed:", n)
+	}
+	if n := g.allow("10.0.0.2", 15, clock.now); n != 5 {
+		t.Error("allow: bundle beyond the burst:", n)
+	}
+	// Other senders have buckets of their own.
+	if n := g.allow("10.0.0.3", 1, clock.now); n != 1 {
+		t.Error("allow: sender limited by another's rate:", n)
+	}
+
+	// The bucket refills at the rate, up to the burst.
+	if n := g.allow("10.0.0.2", 5, clock.advance(300*time.Millisecond)); n != 3 {
+		t.Error("allow: wrong refill:", n)
+	}
+	if n := g.allow("10.0.0.2", 100, clock.advance(time.Hour)); n != 20 {
+		t.Error("allow: refilled beyond the burst:", n)
+	}
+	if stats := g.rejected(); stats.rateLimited != 10+2+80 {
+		t.Error("allow: wrong rate limited count:", stats.rateLimited)
+	}
+}
+
+func TestSenderQuarantine(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	g := testSenderGuard()
+
+	// Malformed packets spread wider than the window are let go.
+	g.reportMalformed("10.0.0.2", clock.now)
+	g.reportMalformed("10.0.0.2", clock.advance(time.Second))
+	if g.reportMalformed("10.0.0.2", clock.advance(10*time.Second)) {
+		t.Error("reportMalformed: quarantined for old malformed packets")
+	}
+
+	// Too many within the window get the sender quarantined, and the
+	// others are not affected.
+	g.reportMalformed("10.0.0.2", clock.advance(time.Second))
+	if !g.reportMalformed("10.0.0.2", clock.advance(time.Second)) {
+		t.Fatal("reportMalformed: sender not quarantined")
+	}
+	if g.admit("10.0.0.2", clock.now) || !g.admit("10.0.0.3", clock.now) {
+		t.Error("admit: wrong senders admitted")
+	}
+	quarantine := g.quarantine(clock.now)
+	if until, ok := quarantine["10.0.0.2"]; len(quarantine) != 1 || !ok || !until.Equal(clock.now.Add(time.Minute)) {
+		t.Error("quarantine: wrong quarantine list:", quarantine)
+	}
+
+	// Idle senders are forgotten, but not while quarantined.
+	g.allow("10.0.0.3", 1, clock.advance(30*time.Second))
+	g.allow("10.0.0.4", 1, clock.advance(29*time.Second))
+	if _, ok := g.senders["10.0.0.3"]; ok {
+		t.Error("sender: idle sender kept")
+	}
+	if _, ok := g.senders["10.0.0.2"]; !ok || g.admit("10.0.0.2", clock.now) {
+		t.Error("sender: quarantined sender forgotten")
+	}
+	g.allow("10.0.0.4", 1, clock.advance(31*time.Second))
+	if _, ok := g.senders["10.0.0.2"]; ok || !g.admit("10.0.0.2", clock.now) || len(g.quarantine(clock.now)) != 0 {
+		t.Error("sender: quarantine did not end")
+	}
+
+	if stats := g.rejected(); stats.malformed != 5 || stats.quarantined != 2 {
+		t.Error("senderGuard: wrong counts:", stats)
+	}
+}
+
+func TestHandleDatagramQuarantine(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MalformedLimit = 2
+	b := New(cfg)
+	now := time.Now()
+	bundle := make([]byte, 0, batPacketBufferSize)
+	packOGMs(&bundle, []RawOGM{sampleOGM})
+	good := datagram{bundle, "10.0.0.2", "10.0.0.1", now}
+	bad := datagram{bundle[:len(bundle)-1], "10.0.0.2", "10.0.0.1", now}
+
+	b.handleDatagram(nil, nil, good)
+	b.handleDatagram(nil, nil, bad)
+	b.handleDatagram(nil, nil, bad)
+	b.handleDatagram(nil, nil, good) // dropped
+	if len(b.inboundOGM) != 1 {
+		t.Error("handleDatagram: OGMs of a quarantined sender queued:", len(b.inboundOGM))
+	}
+	if stats := b.senders.rejected(); stats.malformed != 2 || stats.quarantined != 1 {
+		t.Error("handleDatagram: wrong counts:", stats)
+	}
+}
+
+func TestHandleDatagramBadSQN(t *testing.T) {
+	b := New(defaultConfig())
+	ogm := sampleOGM
+	ogm.SQN = 5000
+	bundle := make([]byte, 0, batPacketBufferSize)
+	packOGMs(&bundle, []RawOGM{ogm})
+
+	// An SQN outside the address range is malformed, not a crash.
+	b.handleDatagram(nil, nil, datagram{bundle, "10.0.0.2", "10.0.0.1", time.Now()})
+	if len(b.inboundOGM) != 0 || b.senders.rejected().malformed != 1 {
+		t.Error("handleDatagram: OGM with out of range SQN not rejected:", len(b.inboundOGM), b.senders.rejected())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The status report is a human readable snapshot of the daemon's state. It is
+// written to the log whenever the daemon receives SIGUSR1, on platforms that
+// have it.
+
+// status builds the status report. Like all routing state, it must only be
+// called from the OGM handler loop.
+func (b *Batman) status() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "status: node %s, SQN %s, metric %s\n", b.id, b.sqn.String(), b.cfg.Metric)
+	if b.cfg.AdaptiveOGMInterval {
+		fmt.Fprintf(&buf, "OGM interval: %v, adaptive between %v and %v\n", b.ogmTimer.interval, b.ogmTimer.min, b.ogmTimer.max)
+	} else {
+		fmt.Fprintf(&buf, "OGM interval: %v\n", b.ogmTimer.interval)
+	}
+
+	sockets := "per interface"
+	if b.sharedConn != nil {
+		sockets = "single wildcard"
+	}
+	if b.cfg.BatchIO {
+		sockets += ", batched I/O"
+	}
+	fmt.Fprintf(&buf, "interfaces: %d, sockets: %s\n", len(b.ifaces), sockets)
+	addrs := make([]ipAddr, 0, len(b.ifaces))
+	for addr := range b.ifaces {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		iface := b.ifaces[addr]
+		role := "secondary"
+		if addr == b.primaryAddr {
+			role = "primary"
+		}
+		s := iface.info.settings
+		transport := "broadcast"
+		if len(s.peers) > 0 {
+			transport = "unicast"
+		} else if s.group != "" {
+			transport = "multicast"
+		}
+		dsts := make([]string, 0, len(s.peers)+1)
+		for _, ip := range iface.info.dsts() {
+			dsts = append(dsts, ip.String())
+		}
+		fmt.Fprintf(&buf, "  %s (%s) %s: %s %s, hop penalty %d, OGM interval %v, MTU %d, packets queued %d/%d, dropped %d\n",
+			addr, iface.info.name, role, transport, strings.Join(dsts, " "), s.hopPenalty, s.ogmInterval, s.mtu,
+			len(iface.packets), cap(iface.packets), iface.packetDrops.Load())
+	}
+
+	depth, droppedOwn, droppedForwarded := b.outbound.stats()
+	fmt.Fprintf(&buf, "queues: outbound %d/%d, dropped %d own and %d forwarded; inbound %d/%d, dropped %d\n",
+		depth, b.outbound.limit, droppedOwn, droppedForwarded,
+		len(b.inboundOGM), cap(b.inboundOGM), b.inboundDrops.Load())
+	fmt.Fprintf(&buf, "queues: hellos %d/%d, dropped %d; probe reports %d/%d, dropped %d\n",
+		len(b.inboundHello), cap(b.inboundHello), b.helloDrops.Load(),
+		len(b.inboundProbeReport), cap(b.inboundProbeReport), b.probeReportDrops.Load())
+
+	now := time.Now()
+	rejected := b.senders.rejected()
+	quarantine := b.senders.quarantine(now)
+	fmt.Fprintf(&buf, "senders: rate limited %d, malformed %d, quarantined %d, dropped while quarantined %d\n",
+		rejected.rateLimited, rejected.malformed, len(quarantine), rejected.quarantined)
+	quarantined := make([]ipAddr, 0, len(quarantine))
+	for addr := range quarantine {
+		quarantined = append(quarantined, addr)
+	}
+	sort.Slice(quarantined, func(i, j int) bool { return quarantined[i] < quarantined[j] })
+	for _, addr := range quarantined {
+		fmt.Fprintf(&buf, "  quarantined %s for %v\n", addr, quarantine[addr].Sub(now).Round(time.Second))
+	}
+
+	neighbors := 0
+	for id := range b.originators.originators {
+		if b.originators.isNeighbor(id) {
+			neighbors++
+		}
+	}
+	fmt.Fprintf(&buf, "neighbors: %d, links: %d, originators: %d, routes: %d\n",
+		neighbors, len(b.originators.linkIndex), len(b.originators.originators), len(b.originators.routes))
+	fmt.Fprintf(&buf, "duplicate OGMs: %d, looped: %d, route switches: %d\n",
+		b.originators.duplicates, b.originators.loops, b.originators.switches)
+	switched := make([]nodeID, 0, len(b.originators.originators))
+	for id, o := range b.originators.originators {
+		if o.switches > 0 {
+			switched = append(switched, id)
+		}
+	}
+	sort.Slice(switched, func(i, j int) bool { return switched[i] < switched[j] })
+	for _, id := range switched {
+		fmt.Fprintf(&buf, "  %s switched next hop %d times\n", id, b.originators.originators[id].switches)
+	}
+	if b.cfg.FishEyeStride > 1 {
+		fmt.Fprintf(&buf, "fish-eye: every %d SQNs from %d hops, thinned %d\n", b.cfg.FishEyeStride, b.cfg.FishEyeHops, b.thinned)
+	}
+	return buf.String()
+}
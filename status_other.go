@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// There is no SIGUSR1 to ask for a status report with.
+func notifyStatus(c chan<- os.Signal) {}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatusSwitches(t *testing.T) {
+	b := New(defaultConfig())
+	b.originators.get("D").switches = 2
+	b.originators.get("E")
+	b.originators.switches = 3
+
+	status := b.status()
+	if !strings.Contains(status, "route switches: 3\n") {
+		t.Error("status: missing the route switch count:", status)
+	}
+	if !strings.Contains(status, "  D switched next hop 2 times\n") || strings.Contains(status, "  E switched") {
+		t.Error("status: wrong per originator switch counts:", status)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatus relays the signal that asks for a status report to c.
+func notifyStatus(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
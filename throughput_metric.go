@@ -0,0 +1,42 @@
+// routing metrics
+
+package main
+
+// The throughput metric follows B.A.T.M.A.N. V: instead of packet delivery
+// ratios, each OGM carries the bottleneck throughput of the path it has
+// travelled. A node receiving an OGM limits the advertised throughput by the
+// throughput of its own link to the sender, so the value that reaches a node
+// is the throughput of the slowest link between it and the originator.
+
+// linkThroughput estimates the throughput (kbit/s) of the link with the
+// given key.
+//
+// A configured rate for the neighbor address or for our interface wins over a
+// probed estimate, which in turn wins over the default rate. Links we do not
+// currently hear are of no use however fast they are, and so count as zero.
+func (t *originatorTable) linkThroughput(key linkKey, link *linkData) uint32 {
+	if link.rqWindow.countHits() < batCutoffRQSamples {
+		return 0
+	}
+	if rate, ok := t.cfg.LinkRates[key.addr]; ok {
+		return rate
+	}
+	if rate, ok := t.cfg.LinkRates[key.iface]; ok {
+		return rate
+	}
+	if link.throughput > 0 {
+		return link.throughput
+	}
+	return t.cfg.DefaultLinkRate
+}
+
+// pathThroughput combines the path throughput reported by a next hop with the
+// throughput of our link to it and the hop penalty. The bottleneck is kept,
+// and the penalty makes shorter paths win between otherwise equal ones.
+func pathThroughput(reported, link uint32, hopPenalty byte) uint32 {
+	bottleneck := reported
+	if link < bottleneck {
+		bottleneck = link
+	}
+	return uint32(uint64(bottleneck) * uint64(batTQMaxValue-int(hopPenalty)) / batTQMaxValue)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathThroughput(t *testing.T) {
+	if tp := pathThroughput(batThroughputMax, 1000, 0); tp != 1000 {
+		t.Error("pathThroughput: link bottleneck not applied:", tp)
+	}
+	if tp := pathThroughput(500, 1000, 0); tp != 500 {
+		t.Error("pathThroughput: path bottleneck not kept:", tp)
+	}
+	if tp := pathThroughput(255, 1000, 10); tp != 245 {
+		t.Error("pathThroughput: hop penalty not applied:", tp)
+	}
+}
+
+// testLink returns the key of a link to ip heard on the tests' own interface.
+func testLink(ip ipAddr) linkKey {
+	return linkKey{"10.0.0.1", ip}
+}
+
+// newTestNeighbor registers a neighbor with one link that has received
+// count consecutive OGMs.
+func newTestNeighbor(b *Batman, id nodeID, ip ipAddr, count int) *linkData {
+	link := b.originators.link(id, testLink(ip))
+	links := b.originators.get(id).links
+	for i := 0; i < count; i++ {
+		links.markReceive(testLink(ip), newDefaultSQN(i), time.Now())
+	}
+	return link
+}
+
+func TestSelectRouteThroughput(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Metric = metricThroughput
+	cfg.LinkRates["10.0.0.2"] = 54000
+	cfg.LinkRates["10.0.0.3"] = 6000
+	cfg.SwitchHoldTime.Duration = 0
+	b := New(cfg)
+
+	newTestNeighbor(&b, "N2", "10.0.0.2", batLocalWindowSize)
+	newTestNeighbor(&b, "N3", "10.0.0.3", batLocalWindowSize)
+
+	// A fast first hop followed by a slow path loses to a slower, even path.
+	b.originators.updatePath("D", testLink("10.0.0.2"), newDefaultSQN(1), batTQMaxValue, 2000, time.Now())
+	b.originators.updatePath("D", testLink("10.0.0.3"), newDefaultSQN(1), batTQMaxValue, 5000, time.Now())
+	b.rebuildRoutingTable()
+
+	if best, ok := b.originators.route("D"); !ok || best.link != testLink("10.0.0.3") {
+		t.Error("selectRoute: throughput bottleneck not used:", b.originators.routes)
+	}
+
+	// A link we no longer hear cannot carry a route.
+	b.originators.get("N3").links[testLink("10.0.0.3")].rqWindow.write(batLocalWindowSize * 3)
+	b.rebuildRoutingTable()
+	if best, ok := b.originators.route("D"); !ok || best.link != testLink("10.0.0.2") {
+		t.Error("selectRoute: silent link still used:", b.originators.routes)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// perfectLink returns a link heard and echoed for a full window up to start.
+func perfectLink(start time.Time, interval time.Duration) *linkData {
+	link := newlinkData(batLocalWindowSize)
+	for i := 0; i < batLocalWindowSize; i++ {
+		link.markReceive(newDefaultSQN(i), batTQMaxValue, start)
+		link.markEcho(newDefaultSQN(i), batTQMaxValue, start)
+	}
+	link.helloSQN = newDefaultSQN(batLocalWindowSize - 1)
+	link.interval = interval
+	return link
+}
+
+func TestLinkDecay(t *testing.T) {
+	interval := batHelloInterval * time.Millisecond
+	start := time.Now()
+	link := perfectLink(start, interval)
+	ownSQN := newDefaultSQN(batLocalWindowSize)
+
+	link.decay(start, ownSQN, interval)
+	if link.tq != batTQMaxValue {
+		t.Error("linkData: decay: TQ lost without missed hellos:", link)
+	}
+
+	// The neighbor falls silent while we keep sending hellos.
+	last := link.tq
+	for missed := 1; missed <= batLocalWindowSize; missed++ {
+		ownSQN.increment()
+		link.decay(start.Add(time.Duration(missed)*interval), ownSQN, interval)
+		if link.tq > last {
+			t.Error("linkData: decay: TQ rose while silent:", missed, link)
+		}
+		last = link.tq
+	}
+	if link.tq != 0 {
+		t.Error("linkData: decay: TQ of silent link did not reach zero:", link)
+	}
+}
+
+func TestLinkDecayCadence(t *testing.T) {
+	interval := batHelloInterval * time.Millisecond
+	start := time.Now()
+
+	// Decaying every hello interval, or once after a few, ends up the same.
+	often, once := perfectLink(start, interval), perfectLink(start, interval)
+	ownSQN := newDefaultSQN(batLocalWindowSize)
+	for missed := 1; missed <= 5; missed++ {
+		ownSQN.increment()
+		often.decay(start.Add(time.Duration(missed)*interval), ownSQN, interval)
+	}
+	once.decay(start.Add(5*interval), ownSQN, interval)
+	if often.rqWindow.countHits() != once.rqWindow.countHits() || often.eqWindow.countHits() != once.eqWindow.countHits() ||
+		once.rqWindow.countHits() != batLocalWindowSize-5 || often.tq != once.tq {
+		t.Error("linkData: decay depends on how often it runs:", often, once)
+	}
+}
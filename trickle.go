@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+)
+
+// Adaptive OGM interval
+//
+// Own OGMs are sent every OGMInterval by default. In adaptive mode the
+// interval follows the Trickle algorithm (RFC 6206): it starts at
+// OGMInterval and doubles after every OGM, up to MaxOGMInterval, for as long
+// as the topology around us holds still. As soon as a link comes or goes or
+// a route changes, it drops back to OGMInterval, so that the news spreads
+// quickly. A stable mesh thus spends little airtime on OGMs, and a moving one
+// reacts fast.
+//
+// Each own OGM advertises the interval until the next one, so that receivers
+// know when to expect it.
+
+// A trickleTimer paces our own OGMs.
+type trickleTimer struct {
+	min      time.Duration
+	max      time.Duration // Equal to min unless the interval is adaptive
+	interval time.Duration // Interval until the next own OGM
+	changes  int           // Topology changes seen so far
+}
+
+func newTrickleTimer(cfg *Config) *trickleTimer {
+	t := &trickleTimer{min: cfg.OGMInterval.Duration, max: cfg.OGMInterval.Duration}
+	if cfg.AdaptiveOGMInterval {
+		t.max = cfg.MaxOGMInterval.Duration
+	}
+	t.interval = t.min
+	return t
+}
+
+// fire returns the interval until the next own OGM, which is the one just
+// advertised, and doubles the interval for the OGM after it.
+func (t *trickleTimer) fire() time.Duration {
+	interval := t.interval
+	if t.interval *= 2; t.interval > t.max {
+		t.interval = t.max
+	}
+	return interval
+}
+
+// observe takes the current count of topology changes. If it moved, the
+// interval drops back to the shortest. It reports whether the interval was
+// longer, in which case the next own OGM may be due sooner than scheduled.
+func (t *trickleTimer) observe(changes int) bool {
+	if changes == t.changes {
+		return false
+	}
+	t.changes = changes
+	longer := t.interval > t.min
+	t.interval = t.min
+	return longer
+}
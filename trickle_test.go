@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrickleTimer(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdaptiveOGMInterval = true
+	cfg.OGMInterval = duration{time.Second}
+	cfg.MaxOGMInterval = duration{5 * time.Second}
+	timer := newTrickleTimer(&cfg)
+
+	// The interval doubles while stable, up to the maximum.
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, timer.fire())
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatal("trickleTimer: wrong intervals:", got)
+		}
+	}
+
+	// A topology change drops it back, once.
+	if timer.observe(0) {
+		t.Error("trickleTimer: reset without a change")
+	}
+	if !timer.observe(3) || timer.interval != time.Second {
+		t.Error("trickleTimer: not reset by a change:", timer.interval)
+	}
+	if timer.observe(3) || timer.observe(4) {
+		t.Error("trickleTimer: reset while at the shortest interval")
+	}
+
+	// Without adaptive mode, the interval holds.
+	cfg.AdaptiveOGMInterval = false
+	timer = newTrickleTimer(&cfg)
+	timer.fire()
+	if timer.fire() != time.Second {
+		t.Error("trickleTimer: fixed interval changed")
+	}
+}
+
+func TestTopologyChanges(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SwitchHoldTime.Duration = 0
+	table := newOriginatorTable("L1", &cfg)
+	key := testLink("10.0.0.2")
+
+	table.link("N2", key).tq = batTQMaxValue
+	table.link("N2", key)
+	if table.changes != 1 {
+		t.Error("originatorTable: new link not counted:", table.changes)
+	}
+	table.updatePath("D", key, newDefaultSQN(1), 200, 0, time.Now())
+	table.updatePath("D", key, newDefaultSQN(2), 200, 0, time.Now())
+	if table.changes != 2 {
+		t.Error("originatorTable: new route not counted once:", table.changes)
+	}
+	table.removeLink("N2", key)
+	table.removeLink("N2", key)
+	table.refreshRoutes(time.Now())
+	if table.changes != 4 {
+		t.Error("originatorTable: lost link and route not counted once:", table.changes)
+	}
+}
+
+func TestAdvertiseOGMInterval(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OGMInterval = duration{2500 * time.Millisecond}
+	b := New(cfg)
+	b.advertiseOGM()
+	ogms := b.outbound.take(nil, 1)
+	if len(ogms) != 1 || ogms[0].Interval != 2500*time.Millisecond {
+		t.Fatal("advertiseOGM: interval not advertised:", ogms)
+	}
+	raw := ogms[0].Pack()
+	if raw.Interval != 2500 || raw.Unpack().Interval != ogms[0].Interval {
+		t.Error("OGM: interval lost on the wire:", raw.Interval)
+	}
+}
@@ -3,10 +3,10 @@ package main
 // Do I need this? +build linux
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
 	"net"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,148 +32,127 @@ func bcastAddr(ipnet *net.IPNet) (net.IP, error) {
 	return net.IP(bcast), nil
 }
 
-// localAndBroadcastAddresses returns a map of loopback addresses to ignore,
-// and a mapping of local interface addresses to their UDP broadcast addresses.
-// Note: All addresses are IPv4 addresses.
-func localAndBroadcastAddresses() (localAddrs map[ipAddr]bool, broadcastAddrs map[ipAddr]net.IP) {
-	// Compile list of local addresses
-	localAddrs = make(map[ipAddr]bool) // list of own (non-loopback) IPv4 addresses
-	broadcastAddrs = make(map[ipAddr]net.IP)
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		panic(err)
+// primaryAddress picks the primary interface address among the local ones:
+// the preferred address if it is local, or else the lowest local address, so
+// that the choice is stable across restarts.
+func primaryAddress(preferred ipAddr, localAddrs map[ipAddr]int) ipAddr {
+	if _, ok := localAddrs[preferred]; ok {
+		return preferred
 	}
-	for _, iface := range ifaces {
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-			// fmt.Println("Iface error:", err)
-		}
-		for _, addr := range addrs {
-			// fmt.Printf("Addr: %T, %v\n", addr, addr)
-			switch t := addr.(type) {
-			case *net.IPNet:
-				// fmt.Printf("IP: %v\n", t.IP.String())
-
-				if (iface.Flags & net.FlagLoopback) != 0 {
-					// fmt.Println("Loopback")
-					continue
-				} else if (iface.Flags & net.FlagUp) == 0 {
-					// interface not up
-					continue
-				} else if (iface.Flags & net.FlagBroadcast) == 0 {
-					// doesn't support broadcast
-					continue
-				} else if t.IP.To4() != nil {
-					// is an IPv4 address
-
-					if bcastIP, err := bcastAddr(t); err == nil {
-						// fmt.Println("The UDP broadcast address for", t, "is", bcastIP)
-						localAddrs[ipAddr(t.IP.String())] = true
-						broadcastAddrs[ipAddr(t.IP.String())] = bcastIP
-						fmt.Println("address found: ", t.IP.To4())
-					}
-
-				}
-			default:
-				// NOOP
-			}
+	var primary ipAddr
+	for addr := range localAddrs {
+		if primary == "" || addrLess(addr, primary) {
+			primary = addr
 		}
 	}
-	if len(broadcastAddrs) < 1 {
-		panic("No broadcast interfaces found!")
-	}
-	return
+	return primary
 }
 
-// resolveUDPAddresses takes a slice of local IPv4 addresses together with a
-// port number and returns UDP addresses as needed for opening UDP sockets.
-func resolveUDPAddresses(localAddrs map[ipAddr]bool, port string) (map[ipAddr]*net.UDPAddr, error) {
-	var err error
-	var errstrings []string
-	udpAddrs := make(map[ipAddr]*net.UDPAddr)
-	for addr := range localAddrs {
-		udpAddr, err := net.ResolveUDPAddr("udp4", string(addr)+":"+port)
-		if err != nil {
-			errstrings = append(errstrings, err.Error())
-		} else {
-			udpAddrs[addr] = udpAddr
-		}
-	}
-	if errstrings != nil {
-		err = errors.New(strings.Join(errstrings, ",'"))
-	}
-	return udpAddrs, err
+// addrLess orders IPv4 addresses numerically.
+func addrLess(a, b ipAddr) bool {
+	ra, rb := a.raw(), b.raw()
+	return bytes.Compare(ra[:], rb[:]) < 0
 }
 
-// openSockets opens network connetions for the resolved list of UDP addrs.
-func openSockets(udpAddrs map[ipAddr]*net.UDPAddr) (map[ipAddr]*net.UDPConn, error) {
-	var err error
-	var errstrings []string
-	sockets := make(map[ipAddr]*net.UDPConn)
-	for k, v := range udpAddrs {
-		// Create UDP socket
-		conn, err := net.ListenUDP("udp4", v)
-		if err != nil {
-			errstrings = append(errstrings, err.Error())
-		} else {
-			sockets[k] = conn
-		}
+// openSocket opens the UDP socket for one local interface address.
+func openSocket(addr ipAddr) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", string(addr)+":"+batUDPPortStr)
+	if err != nil {
+		return nil, fmt.Errorf("openSocket: %v", err)
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("openSocket: %v", err)
 	}
-	if errstrings != nil {
-		err = errors.New(strings.Join(errstrings, ",'"))
+	if err := enableRxTimestamps(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("openSocket: %v", err)
 	}
-	return sockets, err
+	return conn, nil
 }
 
-func closeSockets(udpConns map[ipAddr]*net.UDPConn) (err error) {
-	var errstrings []string
-	for _, conn := range udpConns {
-		if err := conn.Close(); err != nil {
-			errstrings = append(errstrings, err.Error())
-		}
-	}
-	if errstrings != nil {
-		err = errors.New(strings.Join(errstrings, ","))
-	}
-	return
+// A datagram is one received UDP payload together with its addressing.
+type datagram struct {
+	data    []byte
+	srcAddr ipAddr    // Address of the sender
+	rxAddr  ipAddr    // Our own address the datagram was received on
+	rxTime  time.Time // Time the datagram arrived, by the kernel's stamp if there is one
 }
 
-// Call ogmReaderFactory to get a function that will (blocking, 30s) read OGMs
-// from the UDP connection, and once available return them as an OGM slice.
+// Call packetReaderFactory to get a function that will (blocking, 30s) read
+// a datagram from the UDP connection, received on our address rxAddress. The
+// datagram's data is only valid until the next call; OGMs and other packets
+// should be parsed from it right away.
 //
 // Example usage:
-//    readOGMs := ogmReaderFactory(conn, localAddrs)
+//    read := packetReaderFactory(conn, addr, isOwnAddr)
 //    for {
-//    	   if ogms, err = readOGMs(); err == nil {
-//      	    for _, ogm := range ogms {
-//    	  	    fmt.Println(ogm)
+//        if d, err = read(); err == nil && d.data != nil {
+//            ogms, err := parseOGMs(d.data, d.rxAddr)
 //        }
 //    }
 //
-func ogmReaderFactory(conn *net.UDPConn, ignoreAddrs map[ipAddr]bool) func() ([]OGM, error) {
-	data := make([]byte, 4096)
+func packetReaderFactory(conn *net.UDPConn, rxAddress ipAddr, ignore func(ipAddr) bool) func() (datagram, error) {
+	data := make([]byte, batPacketBufferSize)
+	oob := make([]byte, rxOOBSize)
 
-	return func() ([]OGM, error) {
+	return func() (datagram, error) {
 		// Note: It is CRITCAL that conn MUST have a read deadline set.
 		conn.SetReadDeadline(time.Now().Add(time.Second * 30))
-		n, addr, err := conn.ReadFromUDP(data)
+		n, oobn, _, addr, err := conn.ReadMsgUDP(data, oob)
 		if err != nil {
-			return nil, err
+			return datagram{}, err
 			// we expect an error if we close the conn (i.e., Batman instance stopped)
 			// or if the read times out after 30 seconds with no OGMs
 		}
 		// Ignore own transmissions
-		if ignoreAddrs[ipAddr(addr.IP.String())] {
-			return nil, nil
+		if ignore(ipAddr(addr.IP.String())) {
+			return datagram{}, nil
+		}
+		return datagram{data[:n], ipAddr(addr.IP.String()), rxAddress, rxTimestamp(oob[:oobn], time.Now())}, nil
+	}
+}
+
+// singleReads turns a reader of one datagram per call into a reader of
+// batches, for listeners that take either.
+func singleReads(read func() (datagram, error)) func() ([]datagram, error) {
+	batch := make([]datagram, 1)
+	return func() ([]datagram, error) {
+		d, err := read()
+		if err != nil || d.data == nil {
+			return nil, err
 		}
-		// ToDo(Sean): Store addr from read and use it in place of txAddr in ogm.
+		batch[0] = d
+		return batch, nil
+	}
+}
 
-		rxAddress := conn.LocalAddr()
-		return parseOGMs(data[:n], ipAddr(rxAddress.String()))
+// fixedIngress returns an ingress function for a per-interface socket, where
+// every packet arrives on the interface's address rxAddress.
+func fixedIngress(rxAddress ipAddr) func(oob []byte) (ipAddr, bool) {
+	return func([]byte) (ipAddr, bool) {
+		return rxAddress, true
 	}
 }
 
+// packetBuffers pools the buffers that packets are read into and built in,
+// so that batches of them do not have to be allocated over and over.
+var packetBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, batPacketBufferSize)
+		return &buf
+	},
+}
+
+func getPacketBuffer() *[]byte {
+	return packetBuffers.Get().(*[]byte)
+}
+
+func putPacketBuffer(buf *[]byte) {
+	*buf = (*buf)[:cap(*buf)]
+	packetBuffers.Put(buf)
+}
+
 // broadcasterFactory returns a function that will send a byte slice as a
 // UDP broadcast packet on the given connection to the given address.
 func broadcasterFactory(conn *net.UDPConn, linkIP ipAddr, broadcastAddrs net.IP) func([]byte) error {
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// bitWindow is a sliding window of hit/miss flags indexed by a large looping
+// address space, with the same windowing behavior as windowRing.
+//
+// Used by BATMAN to track link measurements (RQ, EQ), where each slot only
+// records whether a packet was heard. Slots are kept as bits in 64-bit words,
+// so that counting hits is a popcount per word, and moving the window costs
+// one shift per word no matter how far it moves.
+//
+// Bit i of the window holds the slot i addresses behind addressHead; bit 0 is
+// the head itself.
+type bitWindow struct {
+	words       []uint64
+	addressSize int
+	windowSize  int
+	addressHead int
+}
+
+func newBitWindow(addressSize, windowSize int) *bitWindow {
+	// Error check input
+	if addressSize < windowSize {
+		panic(fmt.Sprint("batman: newBitWindow: addressSize < windowSize: ", addressSize, "<", windowSize))
+	}
+	if windowSize < 1 {
+		panic(fmt.Sprint("batman: newBitWindow: windowSize < 1: ", windowSize))
+	}
+	return &bitWindow{
+		words:       make([]uint64, (windowSize+63)/64),
+		addressSize: addressSize,
+		windowSize:  windowSize,
+	}
+}
+
+// inWindow tests if the given location, loc, from the large address
+// space is within the current sliding window.
+func (w *bitWindow) inWindow(loc int) bool {
+	return pmod(w.addressHead-loc, w.addressSize) < w.windowSize
+}
+
+// write records a hit (true) or a miss (false) at the address given by loc.
+// If the window does not currently cover loc, it is shifted so that the
+// addressHead points to loc, exactly as for windowRing.write.
+//
+// Calling write without a value does nothing if loc is within the window,
+// but shifts the window head to loc if it is not.
+func (w *bitWindow) write(loc int, hit ...bool) {
+	if loc < 0 || loc >= w.addressSize {
+		panic(fmt.Sprintf("bitWindow: write: loc out of range: %d", loc))
+	}
+	if len(hit) > 1 {
+		panic(fmt.Sprintf("bitWindow: write: too many values"))
+	}
+
+	if !w.inWindow(loc) {
+		w.shift(pmod(loc-w.addressHead, w.addressSize))
+		w.addressHead = loc
+	}
+	if len(hit) == 0 {
+		return
+	}
+
+	i := pmod(w.addressHead-loc, w.addressSize)
+	if hit[0] {
+		w.words[i/64] |= 1 << uint(i%64)
+	} else {
+		w.words[i/64] &^= 1 << uint(i%64)
+	}
+}
+
+// advance shifts the window head forward to loc, just like a write without a
+// value, but only if loc lies ahead of the head. Ahead means less than half
+// the address space away, counting forward from the head.
+func (w *bitWindow) advance(loc int) {
+	if ahead := pmod(loc-w.addressHead, w.addressSize); ahead > 0 && ahead < w.addressSize/2 {
+		w.write(loc)
+	}
+}
+
+// shift moves every slot n places further from the head, dropping those
+// that fall out of the window and clearing the newly exposed ones.
+func (w *bitWindow) shift(n int) {
+	if n >= w.windowSize {
+		for i := range w.words {
+			w.words[i] = 0
+		}
+		return
+	}
+	wordShift, bitShift := n/64, uint(n%64)
+	for i := len(w.words) - 1; i >= 0; i-- {
+		var word uint64
+		if src := i - wordShift; src >= 0 {
+			word = w.words[src] << bitShift
+			if bitShift > 0 && src > 0 {
+				word |= w.words[src-1] >> (64 - bitShift)
+			}
+		}
+		w.words[i] = word
+	}
+	// Clear bits beyond the end of the window.
+	if tail := uint(w.windowSize % 64); tail != 0 {
+		w.words[len(w.words)-1] &= 1<<tail - 1
+	}
+}
+
+// read returns whether a hit is recorded at the given address, and whether
+// that address is within the active window.
+func (w *bitWindow) read(loc int) (hit, ok bool) {
+	i := pmod(w.addressHead-loc, w.addressSize)
+	if i >= w.windowSize {
+		return false, false
+	}
+	return w.words[i/64]&(1<<uint(i%64)) != 0, true
+}
+
+// countHits returns the number of hits recorded in the window.
+func (w *bitWindow) countHits() int {
+	count := 0
+	for _, word := range w.words {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// String constructs a visual text-based representation of the window, oldest
+// slots first.
+func (w *bitWindow) String() string {
+	pic := make([]byte, w.windowSize)
+	for i := range pic {
+		pic[i] = '.'
+		if w.words[(w.windowSize-1-i)/64]&(1<<uint((w.windowSize-1-i)%64)) != 0 {
+			pic[i] = '|'
+		}
+	}
+	return fmt.Sprintf("<bitWindow{%d}: head:%04d (%s)>", w.windowSize, w.addressHead, string(pic))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBitWindow(t *testing.T) {
+	w := newBitWindow(32, 4)
+	w.write(0, true)
+	w.write(1, true)
+	w.write(3, true)
+	if c := w.countHits(); c != 3 {
+		t.Error("bitWindow: countHits error:", c)
+	}
+	if hit, ok := w.read(2); hit || !ok {
+		t.Error("bitWindow: read error:", hit, ok)
+	}
+	w.write(4, true)
+	if w.inWindow(0) || !w.inWindow(1) {
+		t.Error("bitWindow: inWindow error") // falling out of buffer
+	}
+	w.write(1, false)
+	if hit, ok := w.read(1); hit || !ok || w.countHits() != 2 {
+		t.Error("bitWindow: write error: miss not recorded:", w)
+	}
+	w.write(3) // valueless format test
+	if w.countHits() != 2 {
+		t.Error("bitWindow: write error: valueless write changed window:", w)
+	}
+	w.write(30, true)
+	if c := w.countHits(); c != 1 || w.addressHead != 30 {
+		t.Error("bitWindow: write error: rollover:", w)
+	}
+
+	// String test
+	w = newBitWindow(1024, 8)
+	w.write(0, true)
+	w.write(5, true)
+	if w.String() != "<bitWindow{8}: head:0005 (..|....|)>" {
+		t.Error(w.String())
+	}
+
+	// Advance tests
+	w.advance(2)
+	w.advance(700)
+	if w.addressHead != 5 {
+		t.Error("bitWindow: advance error: head moved backward:", w)
+	}
+	w.advance(6)
+	if hit, ok := w.read(5); !hit || !ok || w.addressHead != 6 {
+		t.Error("bitWindow: advance error:", w)
+	}
+}
+
+// TestBitWindowMatchesWindowRing checks the bitmap against windowRing for
+// random writes, across window sizes that do and do not fill whole words.
+func TestBitWindowMatchesWindowRing(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{1, 10, 63, 64, 65, 128, 200} {
+		ring := newWindowRing(batSQNAddrSize, size, 0)
+		bits := newBitWindow(batSQNAddrSize, size)
+		loc := 0
+		for i := 0; i < 5000; i++ {
+			loc = pmod(loc+rng.Intn(size+size/2+2)-size/4, batSQNAddrSize)
+			if rng.Intn(4) == 0 {
+				ring.write(loc)
+				bits.write(loc)
+			} else {
+				ring.write(loc, batTQMaxValue)
+				bits.write(loc, true)
+			}
+			if ring.countHits(batTQMaxValue) != bits.countHits() {
+				t.Fatal("bitWindow: mismatch with windowRing:", size, i, ring, bits)
+			}
+		}
+		for l := 0; l < batSQNAddrSize; l++ {
+			val, ringOK := ring.read(l)
+			hit, bitsOK := bits.read(l)
+			if ringOK != bitsOK || (val == batTQMaxValue) != hit {
+				t.Fatal("bitWindow: read mismatch with windowRing:", size, l)
+			}
+		}
+	}
+}
+
+// The link window benchmarks mark a received packet and recount the window,
+// as every received hello does for each link of its sender.
+
+func benchmarkWindowRing(b *testing.B, size int) {
+	w := newWindowRing(batSQNAddrSize, size, 0)
+	for i := 0; i < b.N; i++ {
+		w.write(i%batSQNAddrSize, batTQMaxValue)
+		_ = w.windowSize - w.countHits(0)
+	}
+}
+
+func benchmarkBitWindow(b *testing.B, size int) {
+	w := newBitWindow(batSQNAddrSize, size)
+	for i := 0; i < b.N; i++ {
+		w.write(i%batSQNAddrSize, true)
+		_ = w.countHits()
+	}
+}
+
+func BenchmarkWindowRing64(b *testing.B)  { benchmarkWindowRing(b, 64) }
+func BenchmarkBitWindow64(b *testing.B)   { benchmarkBitWindow(b, 64) }
+func BenchmarkWindowRing256(b *testing.B) { benchmarkWindowRing(b, 256) }
+func BenchmarkBitWindow256(b *testing.B)  { benchmarkBitWindow(b, 256) }
+
+// BenchmarkProcessHello measures hello handling with many neighbors, each
+// heard on several links, and many originators routed over them.
+func BenchmarkProcessHello(b *testing.B) {
+	for _, neighbors := range []int{10, 100} {
+		b.Run(fmt.Sprintf("neighbors=%d", neighbors), func(b *testing.B) {
+			bat := New(defaultConfig())
+			hellos := make([]hello, 0, neighbors*4)
+			for n := 0; n < neighbors; n++ {
+				for l := 0; l < 4; l++ {
+					hellos = append(hellos, hello{
+						sender:    nodeID(fmt.Sprintf("N%d", n)),
+						neighbors: map[ipAddr]sqn{"10.0.0.1": newDefaultSQN(0)},
+						srcAddr:   ipAddr(fmt.Sprintf("10.%d.%d.%d", l, n/250, n%250+2)),
+						rxAddr:    "10.0.0.1",
+						interval:  batHelloInterval * time.Millisecond,
+					})
+				}
+			}
+			for o := 0; o < neighbors*10; o++ {
+				h := hellos[o%len(hellos)]
+				bat.originators.updatePath(nodeID(fmt.Sprintf("O%d", o)), linkKey{h.rxAddr, h.srcAddr}, newDefaultSQN(1), batTQMaxValue, 0, time.Now())
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h := hellos[i%len(hellos)]
+				h.sqn = newDefaultSQN((i / len(hellos)) % batSQNAddrSize)
+				h.rxTime = time.Now()
+				bat.processHello(h)
+			}
+		})
+	}
+}
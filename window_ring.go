@@ -116,6 +116,16 @@ func (w *windowRing) write(loc int, val ...byte) {
 	}
 }
 
+// advance shifts the window head forward to loc, just like a write without a
+// value, but only if loc lies ahead of the head. Ahead means less than half
+// the address space away, counting forward from the head, so that a stale
+// loc can never wipe the window by wrapping all the way around.
+func (w *windowRing) advance(loc int) {
+	if ahead := pmod(loc-w.addressHead, w.addressSize); ahead > 0 && ahead < w.addressSize/2 {
+		w.write(loc)
+	}
+}
+
 // Read returns the value stored at the given address, if that address is
 // within the active window. Otherwise it returns val as 0 and ok as false
 func (w windowRing) read(loc int) (val byte, ok bool) {
@@ -152,6 +162,15 @@ func (w windowRing) countHitsFunc(f func(byte) bool) int {
 	return count
 }
 
+// sum returns the sum of all values in the ring.
+func (w windowRing) sum() int {
+	total := 0
+	for _, v := range w.ring {
+		total += int(v)
+	}
+	return total
+}
+
 // String constructs a visual text-based representation of the state of the WindowRing.
 func (w *windowRing) String() string {
 	width := 20
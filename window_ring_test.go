@@ -130,4 +130,22 @@ func TestWindowRing(t *testing.T) {
 	}); c != 24+4 {
 		t.Error("windowRing: countHitsFunc error: ", c)
 	}
+
+	// Advance tests
+	wr = newWindowRing(64, 8, 0)
+	wr.write(10, 10)
+	wr.advance(12)
+	correctRing = []byte{10, 0, 0, 0, 0, 0, 0, 0}
+	checkRing(wr.ring, correctRing)
+	if wr.addressHead != 12 {
+		t.Error("windowRing: advance error: head not moved forward:", wr.addressHead)
+	}
+	wr.advance(5)  // behind head
+	wr.advance(50) // more than half the address space ahead
+	if wr.addressHead != 12 {
+		t.Error("windowRing: advance error: head moved backward:", wr.addressHead)
+	}
+	if val, ok := wr.read(10); val != 10 || !ok {
+		t.Error("windowRing: advance error: window cleared:", val, ok)
+	}
 }